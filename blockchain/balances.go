@@ -1,21 +1,24 @@
 package blockchain
 
 import (
-	"crypto/rand"
+	"bytes"
 	"crypto/ecdsa"
-	"crypto/x509"
 	"errors"
 	"math/big"
 
+	"github.com/badlamb/dexm/coin"
 	"github.com/badlamb/dexm/wallet"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/mgo.v2/bson"
 )
 
 type WalletInfo struct {
-	Balance int
+	Balance coin.Amount
 	Nonce   int
-	Burn int
+	Burn    coin.Amount
+
+	// Height of the last burn, Burn is decayed up to this height
+	BurnHeight int64 `bson:"burnheight,omitempty"`
 }
 
 // Generates database of all balances in the blockchain
@@ -35,7 +38,7 @@ func (bc *BlockChain) GenerateBalanceDB() {
 }
 
 // Given a wallet returns balance and nonce
-func (bc *BlockChain) GetBalance(wallet string) (int, int, int) {
+func (bc *BlockChain) GetBalance(wallet string) (coin.Amount, int, coin.Amount) {
 	val, err := bc.Balances.Get([]byte(wallet), nil)
 	if err != nil {
 		log.Error(err)
@@ -50,144 +53,159 @@ func (bc *BlockChain) GetBalance(wallet string) (int, int, int) {
 		return 0, 0, 0
 	}
 
-	return curr.Balance, curr.Nonce, curr.Nonce
+	return curr.Balance, curr.Nonce, curr.Burn
 }
 
-// Stores amount, nonce, and burn for a given wallet 
-func (bc *BlockChain) SetBalance(wallet string, amount, nonce, burn int) error {
-	c := WalletInfo{
-		Balance: amount,
-		Nonce:   nonce,
+// Verify if a transaction has a valid signature. Multisig transactions
+// need a valid signature from at least threshold keys of their script.
+func VerifyTransactionSignature(transaction wallet.Transaction) (bool, error) {
+	hash := transaction.SigningHash()
+
+	if wallet.IsMultisigSender(transaction.Sender) {
+		return verifyMultisig(transaction, hash)
+	}
+
+	if len(transaction.Signatures) != 0 {
+		return false, errors.New("Only multisig transactions can have many signatures")
 	}
 
-	data, err := bson.Marshal(c)
+	senderPub, err := wallet.ParsePublicKey(transaction.Sender)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return bc.Balances.Put([]byte(wallet), data, nil)
+	return verifySignature(senderPub, hash, transaction.SenderSig), nil
 }
 
-// Verify if a transaction has a valid signature
-func VerifyTransactionSignature(transaction wallet.Transaction) (bool, error) {
-	r, s := transaction.SenderSig[0], transaction.SenderSig[1]
-	transaction.SenderSig = [2][]byte{}
+func verifySignature(key *ecdsa.PublicKey, hash []byte, sig [2][]byte) bool {
+	r := new(big.Int).SetBytes(sig[0])
+	s := new(big.Int).SetBytes(sig[1])
 
-	rb := new(big.Int)
-	rb.SetBytes(r)
-
-	sb := new(big.Int)
-	sb.SetBytes(s)
+	return ecdsa.Verify(key, hash, r, s)
+}
 
-	genericPubKey, err := x509.ParsePKIXPublicKey(transaction.Sender)
+func verifyMultisig(transaction wallet.Transaction, hash []byte) (bool, error) {
+	script, err := wallet.DecodeMultisigScript(transaction.Sender)
 	if err != nil {
 		return false, err
 	}
 
-	senderPub := genericPubKey.(*ecdsa.PublicKey)
-
-	marshaled, _ := bson.Marshal(transaction)
-	return ecdsa.Verify(senderPub, marshaled, rb, sb), nil
-}
+	if len(transaction.SenderSig[0]) != 0 || len(transaction.SenderSig[1]) != 0 {
+		return false, errors.New("Multisig transactions can't have a sender signature")
+	}
 
-// Takes in a block and then updates all balances
-func (bc *BlockChain) ProcessBlock(curr *Block) error {
-	var totalGas = 0
+	// Every signature has to be valid, not only threshold of them
+	signed := make(map[int]bool)
+	for _, v := range transaction.Signatures {
+		if v.Key < 0 || v.Key >= len(script.PublicKeys) || signed[v.Key] {
+			return false, errors.New("Invalid signature key")
+		}
 
-	// Genesis node isn't a valid transaction
-	if curr.Index != 0 {
-		var transactions []wallet.Transaction
-		err := bson.Unmarshal(curr.TransactionList, &transactions)
+		key, err := wallet.ParsePublicKey(script.PublicKeys[v.Key])
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		for k, v := range transactions {
-			status, err := VerifyTransactionSignature(v)
-			if err != nil {
-				return err
-			}
-
-			if !status {
-				return errors.New("Invalid signature")
-			}
-
-			sender := wallet.BytesToAddress(v.Sender)
-			balance, nonce, burn := bc.GetBalance(sender)
-
-			// Gas is capped at 1% of the amount. TODO Make gas based on transaction size not
-			// amount, this way all transaction have the same importance to the network.
-			if v.Amount/100 <= v.Gas{
-				return errors.New("Too much gas!")
-			}
-
-			// Check if balance is enough to complete the transaction
-			if v.Amount+v.Gas <= balance {
-				// Check if the transaction is for the Proof of burn addr, if it is then add burn
-				if v.Recipient == "DexmProofOfBurn"{
-					burn += v.Amount
-				}
-
-                bc.SetBalance(sender, balance-(v.Amount+v.Gas), nonce+1, burn)
-
-                totalGas += v.Gas
-
-				// As there was no new transaction on the recivers part the nonce doesn't change
-				rbal, rnonce, rburn := bc.GetBalance(v.Recipient)
-				bc.SetBalance(v.Recipient, rbal+v.Amount, rnonce, rburn)
-			} else {
-				return errors.New("Transaction is invalid " + string(k))
-			}
+		if !verifySignature(key, hash, v.Sig) {
+			return false, nil
 		}
+
+		signed[v.Key] = true
 	}
 
-	// Give the reward for having mined the block.
-	bal, nonce, burn := bc.GetBalance(curr.Miner)
+	return len(signed) >= script.Threshold, nil
+}
+
+// Checks that the gas paid by a transaction is acceptable
+func VerifyTransactionGas(transaction wallet.Transaction) error {
+	if transaction.Gas < 0 {
+		return errors.New("Gas can't be negative")
+	}
+
+	// Gas depends on the size, this way all transactions have the same
+	// importance to the network.
+	minimum, err := MIN_GAS_PRICE.Mul(int64(GetTransactionGas(transaction)))
+	if err != nil {
+		return err
+	}
 
-	bc.SetBalance(curr.Miner, bal+GetReward(5)+totalGas, nonce, burn)
+	if transaction.Gas < minimum {
+		return errors.New("Gas is too low")
+	}
 
 	return nil
 }
 
-// Returns random wallets based on their burn. 
-// TODO Add PoB decay
-func (bc *BlockChain) GetPoBWallets(nodes int) []string{
-	iter := bc.Balances.NewIterator(nil, nil)
-	balances := make(map[int]string)
-	
-	var totalBal int64
+// Checks everything in a transaction that doesn't depend on balances
+func VerifyTransaction(transaction wallet.Transaction) error {
+	status, err := VerifyTransactionSignature(transaction)
+	if err != nil {
+		return err
+	}
 
-	// Get all the balances in memory
-	for iter.Next() {
-		var CurrWall WalletInfo
-		bson.Unmarshal(iter.Value(), &CurrWall)
+	if !status {
+		return errors.New("Invalid signature")
+	}
 
-		balances[CurrWall.Burn] = string(iter.Key())
+	if transaction.Amount <= 0 {
+		return errors.New("Amount has to be positive")
+	}
 
-		totalBal += int64(CurrWall.Burn)
+	// The sender has to be able to pay both
+	_, err = transaction.Amount.Add(transaction.Gas)
+	if err != nil {
+		return err
 	}
 
-	b := big.NewInt(totalBal)
+	err = wallet.ValidateAddress(transaction.Recipient)
+	if err != nil {
+		return err
+	}
+
+	if transaction.Lock < 0 {
+		return errors.New("Lock can't be negative")
+	}
 
-	result := []string{}
-	for i := 0; i<nodes; i++{
-		// Pick a random burn coin in all of the burnt coins.
-		res, _ := rand.Int(rand.Reader, b)
+	return VerifyTransactionGas(transaction)
+}
 
-		burnIndex := new(big.Int)
+// Takes in a block and then updates all balances. Changes are only
+// written if the whole block is valid, together with an undo record
+// that DisconnectBlock uses to revert them.
+func (bc *BlockChain) ProcessBlock(curr *Block) error {
+	state, err := bc.stageBlock(curr)
+	if err != nil {
+		return err
+	}
 
-		for k, v := range balances{
-			// burnIndex <= res
-			status := burnIndex.Cmp(res)
-			if status == -1 || status == 0{
-				result = append(result, v)
-				delete(balances, k)
-				break
-			}else{
-				burnIndex.Add(burnIndex, big.NewInt(int64(k)))
-			}
-		}
+	err = state.Commit(curr.Hash)
+	if err != nil {
+		return err
+	}
+
+	bc.indexBlock(curr, false)
+	return nil
+}
+
+// Applies a block on top of the current balances and checks the state
+// root it commits to, nothing is written yet.
+func (bc *BlockChain) stageBlock(curr *Block) (*BalanceState, error) {
+	state := bc.NewBalanceState()
+
+	err := state.ApplyBlock(curr)
+	if err != nil {
+		return nil, invalidBlock(RULE_TRANSACTIONS, err.Error())
+	}
+
+	// The block has to commit to the state it produces
+	root, err := state.StateRoot()
+	if err != nil {
+		return nil, err
 	}
 
-	return result
-}
\ No newline at end of file
+	if !bytes.Equal(root, curr.StateRoot) {
+		return nil, invalidBlock(RULE_STATE_ROOT, "State root is not correct")
+	}
+
+	return state, nil
+}
@@ -2,9 +2,11 @@ package blockchain
 
 import (
 	"math/big"
-	"errors"
+	"sync"
 	"time"
 
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/params"
 	"github.com/badlamb/dexm/wallet"
 	"github.com/minio/blake2b-simd"
 	log "github.com/sirupsen/logrus"
@@ -20,11 +22,22 @@ type Block struct {
 	TransactionList   []byte `bson:"l,omitempty"`
 	ContractList      []byte `bson:"c,omitempty"`
 	Miner             string `bson:"m"`
+	Difficulty        []byte `bson:"d,omitempty"`
+	MerkleRoot        []byte `bson:"r,omitempty"`
+	StateRoot         []byte `bson:"s,omitempty"`
 }
 
 const (
-	GENESIS_DIFF = 20000000000000
-	USD_REWARD   = 250
+	USD_REWARD = 250
+
+	// Seconds that should pass between two blocks
+	TARGET_BLOCK_TIME = 60
+
+	// How many blocks are used to compute the next difficulty
+	DIFFICULTY_WINDOW = 30
+
+	// Maximum factor the difficulty can change by in a single window
+	MAX_DIFFICULTY_ADJUSTMENT = 4
 )
 
 func (b *Block) CalculateHash() string {
@@ -38,73 +51,155 @@ func (b *Block) CalculateHash() string {
 type BlockChain struct {
 	DB       *leveldb.DB
 	Balances *leveldb.DB
+
+	// Nodes of the state tree, see statetree.go
+	State *leveldb.DB
+
+	// Transaction and address indexes, nil if they are disabled
+	Index *leveldb.DB
+
+	// Held while the main chain or the balances change, blocks arriving
+	// together would otherwise be applied on the same tip
+	lock sync.Mutex
 }
 
-// Generates a new blockchain with only the genesis block
+// Opens the blockchain, a new one only has the genesis block. Same as
+// OpenBlockchain.
 func NewBlockChain() *BlockChain {
-	bc := OpenBlockchain()
-	// generate Genesis Block
-	genesis := Block{
-		Index:           0,
-		Timestamp:       time.Now().Unix(),
-		TransactionList: []byte("Donald Trump Jr was wrong to meet Russian, says FBI chief Christopher Wray"),
-		Miner:           "DexmRGumsYPEB78aD6utysna9Yvs3Fu9614001e",
+	return OpenBlockchain()
+}
+
+// Opens the databases used internally by Dexm, the genesis block is written
+// if the chain doesn't have a tip yet
+func OpenBlockchain() *BlockChain {
+	db, err := leveldb.OpenFile(params.GetPath("blockchain.db"), nil)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	hash := genesis.CalculateHash()
-	genesis.Hash = hash
+	err = checkStorageVersion(db)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	bc.DB.Put([]byte(string(0)), genesis.GetBytes(), nil)
-	bc.GenerateBalanceDB()
-	return bc
-}
+	bal, err := leveldb.OpenFile(params.GetPath("balances.db"), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-// Opens the databases used internally by Dexm
-func OpenBlockchain() *BlockChain {
-	db, err := leveldb.OpenFile("blockchain.db", nil)
+	state, err := leveldb.OpenFile(params.GetPath("state.db"), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bal, err := leveldb.OpenFile("balances.db", nil)
-	return &BlockChain{
+	bc := &BlockChain{
 		DB:       db,
 		Balances: bal,
+		State:    state,
+	}
+
+	// A new chain, indexes are opened first so they include the genesis
+	_, err = db.Get(tipKey, nil)
+	if err == leveldb.ErrNotFound {
+		bc.Index = bc.openIndex()
+
+		err = bc.writeGenesis()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return bc
+	}
+
+	if err != nil {
+		log.Fatal(err)
 	}
+
+	// A database made for another network, or before the genesis was fixed
+	genesis, err := bc.GetBlock(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = VerifyGenesis(genesis, params.Active)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bc.Index = bc.openIndex()
+	return bc
 }
 
-// Returns how many blocks are in the chain
+// Stores the genesis block of the active network as the tip and credits
+// its allocations
+func (bc *BlockChain) writeGenesis() error {
+	genesis := GenesisBlock(params.Active)
+	err := VerifyGenesis(genesis, params.Active)
+	if err != nil {
+		return err
+	}
+
+	// The genesis block has no proof of work
+	mined := &PoWBlock{MinedBlock: genesis}
+
+	err = bc.storeBlock(mined, genesis.GetHeaderDifficulty())
+	if err != nil {
+		return err
+	}
+
+	err = bc.setMainChain([]*PoWBlock{mined}, genesis)
+	if err != nil {
+		return err
+	}
+
+	err = bc.DB.Put(versionKey, encodeInt64(STORAGE_VERSION), nil)
+	if err != nil {
+		return err
+	}
+
+	bc.GenerateBalanceDB()
+	return nil
+}
+
+// Returns how many blocks are in the main chain, the height of the tip + 1
 func (bc *BlockChain) GetLen() int64 {
-	size, err := bc.DB.SizeOf(nil)
+	tip, err := bc.GetTip()
 	if err != nil {
 		log.Error(err)
 		return -1
 	}
 
-	return size.Sum() + 1 
+	return tip.Index + 1
 }
 
 // Returns a block at index i
 func (bc *BlockChain) GetBlock(index int64) (*Block, error) {
-	data, err := bc.DB.Get([]byte(string(index)), nil)
+	mined, err := bc.GetPoWBlock(index)
 	if err != nil {
 		return nil, err
 	}
 
-	var newBlock Block
-	bson.Unmarshal(data, &newBlock)
+	return mined.MinedBlock, nil
+}
 
-	return &newBlock, nil
+// Returns a block at index i together with its proof of work
+func (bc *BlockChain) GetPoWBlock(index int64) (*PoWBlock, error) {
+	hash, err := bc.GetHashAtHeight(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.GetPoWBlockByHash(hash)
 }
 
 type SegwitTransaction struct{
 	Sender    string `bson:"s"`
 	Recipient string `bson:"r"`
 
-	Amount      int       `bson:"a"`
-	Gas         int       `bson:"g"`
-	SenderNonce int       `bson:"n"`
-	Timestamp   int64     `bson:"t"`
+	Amount      coin.Amount `bson:"a"`
+	Gas         coin.Amount `bson:"g"`
+	SenderNonce int         `bson:"n"`
+	Timestamp   int64       `bson:"t"`
 }
 
 // Function that generates a Segwit list of transactions.
@@ -128,63 +223,149 @@ func NewTransactionList(transactions []wallet.Transaction) ([]byte, error){
 	return bson.Marshal(reducedTransactions)
 }
 
+// BSON can't have an array as the root document, so transactions
+// are wrapped in this before being put in a block.
+type transactionWrapper struct {
+	Transactions []wallet.Transaction `bson:"t"`
+}
+
+// Encodes transactions to be used as a block's TransactionList
+func EncodeTransactions(transactions []wallet.Transaction) ([]byte, error) {
+	return bson.Marshal(transactionWrapper{Transactions: transactions})
+}
+
+// Decodes the TransactionList of a block
+func DecodeTransactions(transactionList []byte) ([]wallet.Transaction, error) {
+	// Blocks without transactions have no list at all
+	if len(transactionList) == 0 {
+		return nil, nil
+	}
+
+	var wrapper transactionWrapper
+	err := bson.Unmarshal(transactionList, &wrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapper.Transactions, nil
+}
+
 // Turns transactions and contracts into a block without the proof of work.
-// Then stores it in the DB TODO Only PoW blocks shold be on the DB
-func (bc *BlockChain) NewBlock(transactionList, contractList []byte) {
+// The block isn't stored, it has to be mined and passed to AddBlock.
+func (bc *BlockChain) NewBlock(transactionList, contractList []byte, miner string) (*Block, error) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
 	lastIndex := bc.GetLen() - 1
 	latestBlock, err := bc.GetBlock(lastIndex)
 	if err != nil {
-		log.Error(err)
-		return
+		return nil, err
+	}
+
+	// Clocks can be behind the median of the last blocks
+	timestamp := time.Now().Unix()
+	medianTime, err := bc.GetMedianTimePast(latestBlock.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if timestamp <= medianTime {
+		timestamp = medianTime + 1
 	}
 
 	newB := Block{
 		Index:             latestBlock.Index + 1,
-		Timestamp:         time.Now().Unix(),
-		PreviousBlockHash: latestBlock.CalculateHash(),
+		Timestamp:         timestamp,
+		PreviousBlockHash: latestBlock.Hash,
 		TransactionList:   transactionList,
 		ContractList:      contractList,
+		Miner:             miner,
 	}
 
-	bc.DB.Put([]byte(string(lastIndex+1)), newB.GetBytes(), nil)
+	newB.MerkleRoot, err = newB.ComputeMerkleRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find out what the balances will be after this block
+	state := bc.NewBalanceState()
+	err = state.ApplyBlock(&newB)
+	if err != nil {
+		return nil, err
+	}
+
+	newB.StateRoot, err = state.StateRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	difficulty, err := newB.GetDifficulty(bc)
+	if err != nil {
+		return nil, err
+	}
+
+	newB.Difficulty = difficulty.Bytes()
+	newB.Hash = newB.CalculateHash()
+
+	return &newB, nil
+}
+
+type PoWBlock struct {
+	Nonce      []byte `bson:"n"`
+	MinedBlock *Block `bson:"b"`
 }
 
-type PoWBlock struct{
-	Nonce big.Int
-	MinedBlock *Block
+// Verifies and stores a mined block. Blocks can extend any known block, if
+// the new block's branch has more work than the main chain it becomes the
+// main chain and balances are updated.
+func (bc *BlockChain) AddBlock(minedBlock *PoWBlock) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	return bc.addBlock(minedBlock)
 }
 
-// Verify that a PoW block is valid
-func (bc *BlockChain) VerifyNewBlockValidity(minedBlock *PoWBlock) (bool, error) {
-	latestIndex := bc.GetLen() - 1
-	latestBlock, err := bc.GetBlock(latestIndex)
+func (bc *BlockChain) addBlock(minedBlock *PoWBlock) error {
+	_, err := bc.VerifyNewBlockValidity(minedBlock)
+	if err != nil {
+		return err
+	}
 
 	newBlock := minedBlock.MinedBlock
 
+	parentWork, err := bc.GetWork(newBlock.PreviousBlockHash)
+	if err != nil {
+		return err
+	}
+
+	work := new(big.Int).Add(parentWork, newBlock.GetHeaderDifficulty())
+
+	err = bc.storeBlock(minedBlock, work)
 	if err != nil {
-		return false, err
+		return err
 	}
-	if newBlock.Index != latestIndex+1 {
-		err := errors.New("Block index is not correct")
-		return false, err
-	} else if latestBlock.Hash != newBlock.PreviousBlockHash {
-		err := errors.New("Previous block's hash is not correct")
-		return false, err
-	} else if newBlock.Hash != newBlock.CalculateHash() {
-		err := errors.New("Block hash is not correct")
-		return false, err
+
+	tip, err := bc.GetTip()
+	if err != nil {
+		return err
 	}
 
-	/*hash, err := SumDexmHashVOne(minedBlock.Nonce.Bytes(), newBlock.GetBytes())
-	if err != nil{
-		return false, err
+	tipWork, err := bc.GetWork(tip.Hash)
+	if err != nil {
+		return err
 	}
 
-	if hash > newBlock.GetDifficulty(bc){
-		return false, errors.New("")
-	}*/
+	// On ties the first block seen wins
+	if work.Cmp(tipWork) <= 0 {
+		log.Info("Stored block ", newBlock.Index, " on a side branch")
+		return nil
+	}
+
+	if newBlock.PreviousBlockHash == tip.Hash {
+		return bc.connectBlock(minedBlock, tip)
+	}
 
-	return true, nil
+	return bc.reorganize(minedBlock, tip)
 }
 
 // Turns a block into a []byte
@@ -203,22 +384,76 @@ func (b *Block) GetBytes() []byte {
 	return encoded
 }
 
-// Returns difficulty for a given block
-// This function assumes the block is valid.
-// TODO Implement adjustments based on Shelling results and hashing power
-func (b *Block) GetDifficulty(bc *BlockChain) *big.Int {
-	if b.Index == 0 {
-		genesis := new(big.Int)
-		genesis.SetInt64(GENESIS_DIFF)
-		return genesis
+// Returns the difficulty a block should have based on its ancestors.
+// The sum of the difficulties in the last DIFFICULTY_WINDOW blocks is
+// scaled by how fast they were found compared to TARGET_BLOCK_TIME, this
+// way only a fixed amount of blocks is read.
+// This function assumes the previous blocks are valid, an error means one
+// of them is missing.
+func (b *Block) GetDifficulty(bc *BlockChain) (*big.Int, error) {
+	if b.Index == 0 || params.Active.IsRegtest {
+		return genesisDifficulty(), nil
 	}
 
-	prevBlock, err := bc.GetBlock(b.Index - 1)
+	parent, err := bc.GetBlockByHash(b.PreviousBlockHash)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	// The genesis timestamp is fixed, so the first retarget waits for a
+	// full window of intervals between mined blocks
+	if parent.Index <= DIFFICULTY_WINDOW {
+		return genesisDifficulty(), nil
+	}
+
+	// Walk back the window summing the work of each block
+	sum := new(big.Int)
+	oldest := parent
+
+	for i := 0; i < DIFFICULTY_WINDOW; i++ {
+		sum.Add(sum, oldest.GetHeaderDifficulty())
+
+		oldest, err = bc.GetBlockByHash(oldest.PreviousBlockHash)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return prevBlock.GetDifficulty(bc)
+	// Limit the adjustment, this also takes care of out of order timestamps
+	expected := int64(DIFFICULTY_WINDOW * TARGET_BLOCK_TIME)
+	timespan := parent.Timestamp - oldest.Timestamp
+
+	if timespan < expected/MAX_DIFFICULTY_ADJUSTMENT {
+		timespan = expected / MAX_DIFFICULTY_ADJUSTMENT
+	}
+
+	if timespan > expected*MAX_DIFFICULTY_ADJUSTMENT {
+		timespan = expected * MAX_DIFFICULTY_ADJUSTMENT
+	}
+
+	next := sum.Mul(sum, big.NewInt(TARGET_BLOCK_TIME))
+	next.Div(next, big.NewInt(timespan))
+
+	if next.Sign() <= 0 {
+		next.SetInt64(1)
+	}
+
+	return next, nil
+}
+
+// Returns the difficulty stored in the block
+func (b *Block) GetHeaderDifficulty() *big.Int {
+	// Blocks made before retargeting don't have a difficulty
+	if len(b.Difficulty) == 0 {
+		return genesisDifficulty()
+	}
+
+	return new(big.Int).SetBytes(b.Difficulty)
+}
+
+// Returns the starting difficulty of the active network
+func genesisDifficulty() *big.Int {
+	return big.NewInt(params.Active.GenesisDifficulty)
 }
 
 // Finds reward for a usd price
@@ -226,6 +461,13 @@ func (b *Block) GetDifficulty(bc *BlockChain) *big.Int {
 // using schelling. We do this to keep the price of the coin somewhat stable.
 // There is one huge flaw however: you will get a good hash about 2**256/difficulty
 // times, thus with a higher difficulty the reward should grow.
-func GetReward(usdPrice int) int {
-	return USD_REWARD / usdPrice
+// The reward is computed in base units, this way it doesn't drop to zero
+// once a coin is worth more than USD_REWARD.
+func GetReward(usdPrice int) (coin.Amount, error) {
+	reward, err := coin.COIN.Mul(USD_REWARD)
+	if err != nil {
+		return 0, err
+	}
+
+	return reward.Div(int64(usdPrice))
 }
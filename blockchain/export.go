@@ -0,0 +1,158 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/badlamb/dexm/params"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+Format of exported chains:
+
+	"DXCH" + network magic
+	for every block from the genesis to the tip:
+		4 byte big endian length + PoWBlock bson + 4 byte big endian CRC32 of the bson
+*/
+var exportMagic = []byte("DXCH")
+
+func exportHeader() []byte {
+	return append(append([]byte{}, exportMagic...), params.Active.Magic[:]...)
+}
+
+// Writes all main chain blocks to w, returns how many were written
+func (bc *BlockChain) ExportChain(w io.Writer) (int64, error) {
+	out := bufio.NewWriter(w)
+
+	_, err := out.Write(exportHeader())
+	if err != nil {
+		return 0, err
+	}
+
+	length := bc.GetLen()
+	buf := make([]byte, 4)
+
+	for i := int64(0); i < length; i++ {
+		mined, err := bc.GetPoWBlock(i)
+		if err != nil {
+			return i, err
+		}
+
+		data, err := bson.Marshal(mined)
+		if err != nil {
+			return i, err
+		}
+
+		binary.BigEndian.PutUint32(buf, uint32(len(data)))
+		out.Write(buf)
+		out.Write(data)
+
+		binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(data))
+		_, err = out.Write(buf)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return length, out.Flush()
+}
+
+// Reads blocks written by ExportChain and adds them with AddBlock, this way
+// they go through the same validation as blocks from peers. Blocks that are
+// already known are skipped, so an interrupted import can be run again.
+// Returns how many blocks were added.
+func (bc *BlockChain) ImportChain(r io.Reader) (int64, error) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	in := bufio.NewReader(r)
+
+	header := make([]byte, len(exportHeader()))
+	_, err := io.ReadFull(in, header)
+	if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(header[:len(exportMagic)], exportMagic) {
+		return 0, errors.New("Not an exported chain")
+	}
+
+	if !bytes.Equal(header, exportHeader()) {
+		return 0, errors.New("Chain was exported from another network")
+	}
+
+	imported := int64(0)
+	buf := make([]byte, 4)
+
+	for record := 0; ; record++ {
+		_, err := io.ReadFull(in, buf)
+		if err == io.EOF {
+			return imported, nil
+		}
+
+		if err != nil {
+			return imported, err
+		}
+
+		size := binary.BigEndian.Uint32(buf)
+		if size > MAX_BLOCK_SIZE {
+			return imported, errors.New("Record " + strconv.Itoa(record) + " is too big")
+		}
+
+		data := make([]byte, size)
+		_, err = io.ReadFull(in, data)
+		if err != nil {
+			return imported, err
+		}
+
+		_, err = io.ReadFull(in, buf)
+		if err != nil {
+			return imported, err
+		}
+
+		if binary.BigEndian.Uint32(buf) != crc32.ChecksumIEEE(data) {
+			return imported, errors.New("Checksum of record " + strconv.Itoa(record) + " is wrong")
+		}
+
+		var mined PoWBlock
+		err = bson.Unmarshal(data, &mined)
+		if err != nil {
+			return imported, err
+		}
+
+		if mined.MinedBlock == nil {
+			return imported, errors.New("Record " + strconv.Itoa(record) + " has no block")
+		}
+
+		// The genesis is never added, but it has to be the same
+		if mined.MinedBlock.Index == 0 {
+			err = VerifyGenesis(mined.MinedBlock, params.Active)
+			if err != nil {
+				return imported, err
+			}
+
+			continue
+		}
+
+		if bc.HasBlock(mined.MinedBlock.Hash) {
+			continue
+		}
+
+		err = bc.addBlock(&mined)
+		if err != nil {
+			return imported, errors.New("Block " + strconv.FormatInt(mined.MinedBlock.Index, 10) + " is invalid: " + err.Error())
+		}
+
+		imported++
+		if imported%1000 == 0 {
+			log.Info("Imported ", imported, " blocks")
+		}
+	}
+}
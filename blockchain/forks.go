@@ -0,0 +1,251 @@
+package blockchain
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns a block with a given hash, even if it's not on the main chain
+func (bc *BlockChain) GetBlockByHash(hash string) (*Block, error) {
+	mined, err := bc.GetPoWBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return mined.MinedBlock, nil
+}
+
+// Returns a block with a given hash together with its proof of work
+func (bc *BlockChain) GetPoWBlockByHash(hash string) (*PoWBlock, error) {
+	data, err := bc.DB.Get(prefixedKey(blockPrefix, hash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var mined PoWBlock
+	err = bson.Unmarshal(data, &mined)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mined, nil
+}
+
+// Checks if a block has already been stored
+func (bc *BlockChain) HasBlock(hash string) bool {
+	ok, err := bc.DB.Has(prefixedKey(blockPrefix, hash), nil)
+	return err == nil && ok
+}
+
+// Returns the total work of the chain ending with the block hash
+func (bc *BlockChain) GetWork(hash string) (*big.Int, error) {
+	data, err := bc.DB.Get(prefixedKey(workPrefix, hash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Returns the last block of the main chain
+func (bc *BlockChain) GetTip() (*Block, error) {
+	hash, err := bc.DB.Get(tipKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.GetBlockByHash(string(hash))
+}
+
+// Stores a block by hash with the total work of its branch
+func (bc *BlockChain) storeBlock(minedBlock *PoWBlock, work *big.Int) error {
+	encoded, err := bson.Marshal(minedBlock)
+	if err != nil {
+		return err
+	}
+
+	b := minedBlock.MinedBlock
+
+	batch := new(leveldb.Batch)
+	batch.Put(prefixedKey(blockPrefix, b.Hash), encoded)
+	batch.Put(prefixedKey(workPrefix, b.Hash), work.Bytes())
+
+	// Lets forgetBlocks find the descendants of a block
+	if b.Index > 0 {
+		batch.Put(childKey(b.PreviousBlockHash, b.Hash), nil)
+	}
+
+	return bc.DB.Write(batch, nil)
+}
+
+// Removes blocks that turned out to be invalid together with all their
+// stored descendants, this way they won't be considered again when choosing
+// the heaviest branch.
+func (bc *BlockChain) forgetBlocks(blocks []*PoWBlock) {
+	batch := new(leveldb.Batch)
+	forgotten := make(map[string]bool)
+
+	// Pairs of parent and block hashes
+	queue := [][2]string{}
+	for _, v := range blocks {
+		queue = append(queue, [2]string{v.MinedBlock.PreviousBlockHash, v.MinedBlock.Hash})
+	}
+
+	for len(queue) > 0 {
+		parent, hash := queue[0][0], queue[0][1]
+		queue = queue[1:]
+
+		if forgotten[hash] {
+			continue
+		}
+		forgotten[hash] = true
+
+		batch.Delete(prefixedKey(blockPrefix, hash))
+		batch.Delete(prefixedKey(workPrefix, hash))
+		batch.Delete(childKey(parent, hash))
+
+		prefix := prefixedKey(childPrefix, hash)
+		iter := bc.DB.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			queue = append(queue, [2]string{hash, string(iter.Key()[len(prefix):])})
+		}
+		iter.Release()
+
+		if iter.Error() != nil {
+			log.Error(iter.Error())
+		}
+	}
+
+	err := bc.DB.Write(batch, nil)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Makes consecutive blocks part of the main chain and moves the tip to the
+// last one. Main chain blocks they replace or that are above the new tip
+// are removed from the height indexes.
+func (bc *BlockChain) setMainChain(blocks []*PoWBlock, oldTip *Block) error {
+	batch := new(leveldb.Batch)
+
+	first := blocks[0].MinedBlock.Index
+	for i := first; i <= oldTip.Index; i++ {
+		hash, err := bc.GetHashAtHeight(i)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		batch.Delete(heightKey(i))
+		batch.Delete(prefixedKey(indexPrefix, hash))
+	}
+
+	for _, v := range blocks {
+		batch.Put(heightKey(v.MinedBlock.Index), []byte(v.MinedBlock.Hash))
+		batch.Put(prefixedKey(indexPrefix, v.MinedBlock.Hash), encodeInt64(v.MinedBlock.Index))
+	}
+
+	batch.Put(tipKey, []byte(blocks[len(blocks)-1].MinedBlock.Hash))
+
+	return bc.DB.Write(batch, nil)
+}
+
+// Applies a block on top of the current tip
+func (bc *BlockChain) connectBlock(minedBlock *PoWBlock, oldTip *Block) error {
+	err := bc.ProcessBlock(minedBlock.MinedBlock)
+	if err != nil {
+		bc.forgetBlocks([]*PoWBlock{minedBlock})
+		return err
+	}
+
+	return bc.setMainChain([]*PoWBlock{minedBlock}, oldTip)
+}
+
+// Switches the main chain to the branch ending with minedBlock. Blocks are
+// disconnected down to the last block both chains have in common and then
+// the blocks in the new branch are applied.
+func (bc *BlockChain) reorganize(minedBlock *PoWBlock, oldTip *Block) error {
+	// Walk back the new branch until a block on the main chain is found
+	branch := []*PoWBlock{minedBlock}
+	curr := minedBlock.MinedBlock
+
+	var fork *Block
+	for fork == nil {
+		parent, err := bc.GetPoWBlockByHash(curr.PreviousBlockHash)
+		if err != nil {
+			return err
+		}
+
+		if bc.IsMainChain(parent.MinedBlock.Hash) {
+			fork = parent.MinedBlock
+			continue
+		}
+
+		branch = append([]*PoWBlock{parent}, branch...)
+		curr = parent.MinedBlock
+	}
+
+	log.Info("Reorganizing chain, fork at block ", fork.Index, ", ", len(branch), " new blocks")
+
+	// Undo the main chain down to the fork, newest block first
+	disconnected := []*PoWBlock{}
+	for i := oldTip.Index; i > fork.Index; i-- {
+		curr, err := bc.GetPoWBlock(i)
+		if err != nil {
+			bc.restoreChain(nil, disconnected)
+			return err
+		}
+
+		// Blocks disconnected so far are reapplied so the balances match
+		// the tip again
+		err = bc.DisconnectBlock(curr.MinedBlock)
+		if err != nil {
+			bc.restoreChain(nil, disconnected)
+			return errors.New("Unable to disconnect block " + strconv.FormatInt(i, 10) + ": " + err.Error())
+		}
+
+		disconnected = append([]*PoWBlock{curr}, disconnected...)
+	}
+
+	for k, v := range branch {
+		err := bc.ProcessBlock(v.MinedBlock)
+		if err == nil {
+			continue
+		}
+
+		// The new branch is invalid, go back to the old chain
+		bc.forgetBlocks(branch[k:])
+		bc.restoreChain(branch[:k], disconnected)
+
+		return err
+	}
+
+	return bc.setMainChain(branch, oldTip)
+}
+
+// Disconnects the applied part of a failed branch and reapplies the blocks
+// that were on the main chain before.
+func (bc *BlockChain) restoreChain(applied, disconnected []*PoWBlock) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		err := bc.DisconnectBlock(applied[i].MinedBlock)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	for _, v := range disconnected {
+		err := bc.ProcessBlock(v.MinedBlock)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/wallet"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Gas used by every transaction on top of the gas for its size
+	TRANSACTION_GAS = 1
+
+	// Bytes of an encoded transaction paid by one unit of gas
+	BYTES_PER_GAS = 100
+
+	// Contracts are stored and run by every node, so they cost more
+	CONTRACT_BYTES_PER_GAS = 25
+
+	// Minimum amount paid for every unit of gas
+	MIN_GAS_PRICE coin.Amount = 1
+
+	// Maximum gas used by all the transactions in a block
+	MAX_BLOCK_GAS = 10000
+)
+
+func divideRoundingUp(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// Returns the gas used by a transaction. It depends on the size of the
+// transaction and of the attached contract, not on the amount sent.
+func GetTransactionGas(t wallet.Transaction) int {
+	contract := t.Contract
+	t.Contract = nil
+
+	encoded, err := bson.Marshal(t)
+	if err != nil {
+		log.Error(err)
+		return math.MaxInt32
+	}
+
+	return TRANSACTION_GAS + divideRoundingUp(len(encoded), BYTES_PER_GAS) +
+		divideRoundingUp(len(contract), CONTRACT_BYTES_PER_GAS)
+}
+
+// Returns how much a transaction pays for every unit of gas it uses
+func GetGasPrice(t wallet.Transaction) coin.Amount {
+	price, err := t.Gas.Div(int64(GetTransactionGas(t)))
+	if err != nil {
+		return 0
+	}
+
+	return price
+}
+
+// Returns the most gas a transaction with a given contract can use, this
+// way the fee can be chosen before the transaction is signed.
+func EstimateTransactionGas(contract []byte) int {
+	// Fill every field with the largest value it can have, ints are
+	// bounded by 32 bit platforms
+	largest := wallet.Transaction{
+		Sender:      make([]byte, 91),
+		Recipient:   strings.Repeat("x", 64),
+		Amount:      coin.MAX_AMOUNT,
+		Gas:         coin.MAX_AMOUNT,
+		SenderNonce: math.MaxInt32,
+		Timestamp:   math.MaxInt64,
+		SenderSig:   [2][]byte{make([]byte, 33), make([]byte, 33)},
+		Contract:    contract,
+		Lock:        math.MaxInt64,
+	}
+
+	return GetTransactionGas(largest)
+}
+
+// Like EstimateTransactionGas, but for a transaction from a multisig
+// address signed by threshold keys
+func EstimateMultisigGas(script *wallet.MultisigScript) int {
+	largest := wallet.Transaction{
+		Sender:      script.Encode(),
+		Recipient:   strings.Repeat("x", 64),
+		Amount:      coin.MAX_AMOUNT,
+		Gas:         coin.MAX_AMOUNT,
+		SenderNonce: math.MaxInt32,
+		Timestamp:   math.MaxInt64,
+		Lock:        math.MaxInt64,
+	}
+
+	for i := 0; i < script.Threshold; i++ {
+		largest.Signatures = append(largest.Signatures, wallet.MultiSignature{
+			Key: math.MaxInt32,
+			Sig: [2][]byte{make([]byte, 33), make([]byte, 33)},
+		})
+	}
+
+	return GetTransactionGas(largest)
+}
+
+// Returns the median gas price paid by transactions in the last blocks of
+// the main chain, or MIN_GAS_PRICE if there are none.
+func (bc *BlockChain) GetRecentGasPrice(blocks int64) coin.Amount {
+	prices := []coin.Amount{}
+
+	for i := bc.GetLen() - 1; i > 0 && i >= bc.GetLen()-blocks; i-- {
+		curr, err := bc.GetBlock(i)
+		if err != nil {
+			log.Error(err)
+			break
+		}
+
+		transactions, err := DecodeTransactions(curr.TransactionList)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, v := range transactions {
+			prices = append(prices, GetGasPrice(v))
+		}
+	}
+
+	if len(prices) == 0 {
+		return MIN_GAS_PRICE
+	}
+
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i] < prices[j]
+	})
+
+	return prices[len(prices)/2]
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/params"
+	log "github.com/sirupsen/logrus"
+)
+
+// Builds the genesis block of a network. It only depends on the network
+// parameters, so every node ends up with the same block.
+func GenesisBlock(net *params.Network) *Block {
+	genesis := Block{
+		Index:           0,
+		Timestamp:       net.GenesisTimestamp,
+		TransactionList: []byte(net.GenesisMessage),
+		Miner:           net.GenesisMiner,
+		Difficulty:      big.NewInt(net.GenesisDifficulty).Bytes(),
+		StateRoot:       genesisStateRoot(net),
+	}
+
+	genesis.Hash = genesis.CalculateHash()
+	return &genesis
+}
+
+// The genesis block starts from an empty state and only gives out the
+// allocations of the network.
+func genesisStateRoot(net *params.Network) []byte {
+	balances := make(map[string]coin.Amount)
+	for _, v := range net.Allocations {
+		// SetGenesisAllocations checks that the total fits
+		balance, err := balances[v.Address].Add(v.Amount)
+		if err != nil {
+			log.Error(err)
+		}
+
+		balances[v.Address] = balance
+	}
+
+	accounts := []AccountLeaf{}
+	for k, v := range balances {
+		accounts = append(accounts, AccountLeaf{Wallet: k, Info: WalletInfo{Balance: v}})
+	}
+
+	// The tree starts empty, so no nodes have to be read
+	tree := newStateTree(nil, emptyNode)
+	err := tree.set(accounts)
+	if err != nil {
+		log.Error(err)
+	}
+
+	return tree.root
+}
+
+// Replaces the allocations of a regtest network, this way tests can start
+// with funded accounts. The genesis hash changes, so the same allocations
+// have to be used every time the chain is opened.
+func SetGenesisAllocations(net *params.Network, allocations []params.Allocation) error {
+	if !net.IsRegtest {
+		return errors.New("Allocations can only be changed on regtest")
+	}
+
+	var total coin.Amount
+	for _, v := range allocations {
+		var err error
+		total, err = total.Add(v.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	net.Allocations = allocations
+	net.GenesisHash = hex.EncodeToString([]byte(GenesisBlock(net).Hash))
+
+	return nil
+}
+
+// Checks that a genesis block is the one of the given network
+func VerifyGenesis(genesis *Block, net *params.Network) error {
+	if hex.EncodeToString([]byte(genesis.Hash)) != net.GenesisHash {
+		return errors.New("Genesis block doesn't match the " + net.Name + " genesis")
+	}
+
+	return nil
+}
+
+// Returns the hex encoded hash of the genesis block in the database
+func (bc *BlockChain) GetGenesisHash() (string, error) {
+	hash, err := bc.GetHashAtHeight(0)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString([]byte(hash)), nil
+}
@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/minio/blake2b-simd"
+)
+
+// Leaves and inner nodes are hashed with a different prefix, this way an
+// inner node can't be passed off as a transaction id.
+const (
+	MERKLE_LEAF_PREFIX = 0x00
+	MERKLE_NODE_PREFIX = 0x01
+)
+
+// A hash needed to go one level up in the tree. Left is true if the
+// sibling is on the left of the node being proven.
+type MerkleSibling struct {
+	Hash []byte `bson:"h" json:"hash"`
+	Left bool   `bson:"l" json:"left"`
+}
+
+// Proves that a leaf is part of a tree with a given root
+type MerkleProof struct {
+	Siblings []MerkleSibling `bson:"s" json:"siblings"`
+}
+
+func merkleLeaf(data []byte) []byte {
+	hash := blake2b.Sum256(append([]byte{MERKLE_LEAF_PREFIX}, data...))
+	return hash[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	buf := append([]byte{MERKLE_NODE_PREFIX}, left...)
+	hash := blake2b.Sum256(append(buf, right...))
+	return hash[:]
+}
+
+// Hashes the level above the given one. A node without a sibling is moved
+// up unchanged instead of being paired with itself.
+func merkleLevel(level [][]byte) [][]byte {
+	next := [][]byte{}
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+	}
+
+	return next
+}
+
+// Computes the root of a merkle tree. The root of an empty tree is all zeros.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return make([]byte, 32)
+	}
+
+	level := [][]byte{}
+	for _, v := range leaves {
+		level = append(level, merkleLeaf(v))
+	}
+
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+
+	return level[0]
+}
+
+// Builds a proof that leaves[index] is in the tree
+func NewMerkleProof(leaves [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, errors.New("Leaf index is out of range")
+	}
+
+	level := [][]byte{}
+	for _, v := range leaves {
+		level = append(level, merkleLeaf(v))
+	}
+
+	proof := &MerkleProof{}
+	for len(level) > 1 {
+		if index%2 == 1 {
+			proof.Siblings = append(proof.Siblings, MerkleSibling{Hash: level[index-1], Left: true})
+		} else if index+1 < len(level) {
+			proof.Siblings = append(proof.Siblings, MerkleSibling{Hash: level[index+1], Left: false})
+		}
+
+		level = merkleLevel(level)
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// Checks that a proof links leaf to root
+func VerifyMerkleProof(leaf, root []byte, proof *MerkleProof) bool {
+	hash := merkleLeaf(leaf)
+
+	for _, v := range proof.Siblings {
+		if v.Left {
+			hash = merkleNode(v.Hash, hash)
+		} else {
+			hash = merkleNode(hash, v.Hash)
+		}
+	}
+
+	return bytes.Equal(hash, root)
+}
+
+// Returns the ids of all transactions in a block
+func (b *Block) GetTransactionIds() ([][]byte, error) {
+	transactions, err := DecodeTransactions(b.TransactionList)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := [][]byte{}
+	for _, v := range transactions {
+		ids = append(ids, v.GetHash())
+	}
+
+	return ids, nil
+}
+
+// Computes the merkle root of the transactions in a block
+func (b *Block) ComputeMerkleRoot() ([]byte, error) {
+	ids, err := b.GetTransactionIds()
+	if err != nil {
+		return nil, err
+	}
+
+	return MerkleRoot(ids), nil
+}
+
+// Builds a proof that a transaction is in the block
+func (b *Block) GetMerkleProof(txid []byte) (*MerkleProof, error) {
+	ids, err := b.GetTransactionIds()
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range ids {
+		if bytes.Equal(v, txid) {
+			return NewMerkleProof(ids, k)
+		}
+	}
+
+	return nil, errors.New("Transaction is not in the block")
+}
@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/badlamb/dexm/coin"
+	"github.com/minio/blake2b-simd"
+)
+
+// Every BURN_HALF_LIFE blocks the weight of a burn is halved
+const BURN_HALF_LIFE = 7 * 24 * 60
+
+// Returns what is left of a burn after age blocks
+func DecayBurn(burn coin.Amount, age int64) coin.Amount {
+	if age < 0 {
+		age = 0
+	}
+
+	halvings := age / BURN_HALF_LIFE
+	if halvings >= 63 {
+		return 0
+	}
+
+	return burn >> uint(halvings)
+}
+
+// Returns the weight of the burn of a wallet at a given height
+func (w WalletInfo) GetBurnAt(height int64) coin.Amount {
+	return DecayBurn(w.Burn, height-w.BurnHeight)
+}
+
+// Returns a number in [0, max) derived from seed and counter
+func seededInt(seed []byte, counter uint64, max *big.Int) *big.Int {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	hash := blake2b.Sum256(append(append([]byte{}, seed...), buf...))
+	return new(big.Int).Mod(new(big.Int).SetBytes(hash[:]), max)
+}
+
+// Picks up to nodes different wallets, each with a chance proportional to
+// its burn decayed to height. The result only depends on the arguments, so
+// anyone with the same accounts and seed can check the selection. Accounts
+// have to be sorted by address, like the leaves of the state root.
+func SelectPoBWallets(accounts []AccountLeaf, seed []byte, height int64, nodes int) []string {
+	candidates := []AccountLeaf{}
+	weights := []*big.Int{}
+	total := new(big.Int)
+
+	for _, v := range accounts {
+		weight := v.Info.GetBurnAt(height)
+		if weight <= 0 {
+			continue
+		}
+
+		candidates = append(candidates, v)
+		weights = append(weights, big.NewInt(int64(weight)))
+		total.Add(total, weights[len(weights)-1])
+	}
+
+	result := []string{}
+	for i := 0; i < nodes && len(candidates) > 0; i++ {
+		// Pick a random burnt coin and find who burnt it
+		target := seededInt(seed, uint64(i), total)
+		sum := new(big.Int)
+
+		for k, v := range weights {
+			sum.Add(sum, v)
+			if target.Cmp(sum) >= 0 {
+				continue
+			}
+
+			result = append(result, candidates[k].Wallet)
+
+			// Winners can't be picked twice
+			total.Sub(total, v)
+			candidates = append(candidates[:k], candidates[k+1:]...)
+			weights = append(weights[:k], weights[k+1:]...)
+			break
+		}
+	}
+
+	return result
+}
+
+// Returns wallets picked by their burn in the state committed by the block
+// with the given hash, seeded with the same hash. Every node picks the same
+// wallets for a block, even after the chain moved on.
+func (bc *BlockChain) GetPoBWallets(hash string, nodes int) ([]string, error) {
+	b, err := bc.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := bc.GetAccounts(b.StateRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return SelectPoBWallets(accounts, []byte(b.Hash), b.Index, nodes), nil
+}
@@ -8,7 +8,8 @@ import(
 
 // First version of the PoW hash. Uses lyra2rev2
 func SumDexmHashVOne(nonce, block []byte) (*big.Int, error){
-    toHash := append(nonce, block...)
+    // Copy the nonce, appending to it could overwrite the buffer it was decoded from
+    toHash := append(append([]byte{}, nonce...), block...)
 
     result := new(big.Int)
 
@@ -21,3 +22,21 @@ func SumDexmHashVOne(nonce, block []byte) (*big.Int, error){
 
     return result, nil
 }
+
+// Returns the hash a block has to be below of to be valid. On average
+// 2**256/difficulty hashes are needed to find it.
+func GetTarget(difficulty *big.Int) *big.Int {
+    target := new(big.Int).Lsh(big.NewInt(1), 256)
+
+    return target.Div(target, difficulty)
+}
+
+// Computes the PoW hash of a mined block with the algorithm active at its height
+func (pb *PoWBlock) GetPoWHash() (*big.Int, error) {
+    algorithm, err := GetPoWAlgorithm(pb.MinedBlock.Index)
+    if err != nil {
+        return nil, err
+    }
+
+    return algorithm.Sum(pb.Nonce, pb.MinedBlock.GetBytes())
+}
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/badlamb/dexm/params"
+	"github.com/minio/blake2b-simd"
+)
+
+// A proof of work algorithm. Which one a block uses depends on its height
+// and on the PoWSchedule of the network, this way a new algorithm can be
+// activated at a planned height.
+type PoWAlgorithm interface {
+	// Name used in the PoW schedule of networks
+	Name() string
+
+	// Hashes a nonce and an encoded block, the result has to be below
+	// the target of the block
+	Sum(nonce, block []byte) (*big.Int, error)
+}
+
+// Algorithms that can be used in a PoW schedule, by name
+var powAlgorithms = make(map[string]PoWAlgorithm)
+
+func init() {
+	RegisterPoW(lyra2rev2PoW{})
+	RegisterPoW(blake2bPoW{})
+}
+
+// Makes an algorithm available to PoW schedules
+func RegisterPoW(algorithm PoWAlgorithm) {
+	powAlgorithms[algorithm.Name()] = algorithm
+}
+
+// The algorithm used since the first block
+type lyra2rev2PoW struct{}
+
+func (lyra2rev2PoW) Name() string {
+	return params.POW_LYRA2REV2
+}
+
+func (lyra2rev2PoW) Sum(nonce, block []byte) (*big.Int, error) {
+	return SumDexmHashVOne(nonce, block)
+}
+
+// A cheap algorithm, used on regtest to try out switching algorithms
+type blake2bPoW struct{}
+
+func (blake2bPoW) Name() string {
+	return params.POW_BLAKE2B
+}
+
+func (blake2bPoW) Sum(nonce, block []byte) (*big.Int, error) {
+	hash := blake2b.Sum256(append(append([]byte{}, nonce...), block...))
+	return new(big.Int).SetBytes(hash[:]), nil
+}
+
+// Returns the algorithm blocks at a given height are mined with
+func GetPoWAlgorithm(height int64) (PoWAlgorithm, error) {
+	schedule := params.Active.PoWSchedule
+
+	// The last activation at or below height
+	for i := len(schedule) - 1; i >= 0; i-- {
+		if schedule[i].Height > height {
+			continue
+		}
+
+		algorithm, ok := powAlgorithms[schedule[i].Algorithm]
+		if !ok {
+			return nil, errors.New("Unknown PoW algorithm " + schedule[i].Algorithm)
+		}
+
+		return algorithm, nil
+	}
+
+	return nil, errors.New("No PoW algorithm at height " + strconv.FormatInt(height, 10))
+}
+
+// Checks that a schedule starts at height 0, has increasing heights and
+// only uses registered algorithms
+func VerifyPoWSchedule(schedule []params.PoWActivation) error {
+	if len(schedule) == 0 || schedule[0].Height != 0 {
+		return errors.New("PoW schedule has to start at height 0")
+	}
+
+	for k, v := range schedule {
+		if k > 0 && v.Height <= schedule[k-1].Height {
+			return errors.New("PoW schedule heights have to increase")
+		}
+
+		if _, ok := powAlgorithms[v.Algorithm]; !ok {
+			return errors.New("Unknown PoW algorithm " + v.Algorithm)
+		}
+	}
+
+	return nil
+}
+
+// Replaces the PoW schedule of a regtest network. All nodes of the
+// network have to use the same schedule.
+func SetPoWSchedule(net *params.Network, schedule []params.PoWActivation) error {
+	if !net.IsRegtest {
+		return errors.New("The PoW schedule can only be changed on regtest")
+	}
+
+	err := VerifyPoWSchedule(schedule)
+	if err != nil {
+		return err
+	}
+
+	net.PoWSchedule = schedule
+	return nil
+}
@@ -0,0 +1,325 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returned when a transaction doesn't have the next nonce of its sender
+var (
+	ErrNonceUsed = errors.New("Nonce has already been used")
+	ErrNonceGap  = errors.New("Nonce skips over unused nonces")
+)
+
+// Returned when a transaction is included before its lock expired
+var ErrLocked = errors.New("Transaction is still locked")
+
+// Checks that nonce directly follows the last nonce used by a sender
+func CheckNonce(nonce, lastNonce int) error {
+	if nonce <= lastNonce {
+		return ErrNonceUsed
+	}
+
+	if nonce > lastNonce+1 {
+		return ErrNonceGap
+	}
+
+	return nil
+}
+
+// Checks that the lock of a transaction allows it in a block with the
+// given height and timestamp
+func CheckLock(t wallet.Transaction, height, timestamp int64) error {
+	if t.Lock < wallet.LOCK_TIME_THRESHOLD && height < t.Lock {
+		return ErrLocked
+	}
+
+	if t.Lock >= wallet.LOCK_TIME_THRESHOLD && timestamp < t.Lock {
+		return ErrLocked
+	}
+
+	return nil
+}
+
+// BalanceState stages changes to balances in memory on top of the balances
+// database. Nothing is written until Commit is called, this way a block is
+// either applied completely or not at all.
+type BalanceState struct {
+	bc      *BlockChain
+	changes map[string]WalletInfo
+
+	// Height and timestamp of the block being applied, used to decay burns
+	// and check locks
+	height    int64
+	timestamp int64
+
+	// State root of the balances database and the tree with the staged
+	// changes, nil until StateRoot is called
+	root []byte
+	tree *stateTree
+}
+
+// Creates an empty overlay on top of the balances database
+func (bc *BlockChain) NewBalanceState() *BalanceState {
+	root, err := readStateRoot(bc.Balances)
+	if err != nil {
+		log.Error(err)
+	}
+
+	return &BalanceState{
+		bc:        bc,
+		changes:   make(map[string]WalletInfo),
+		height:    bc.GetLen(),
+		timestamp: time.Now().Unix(),
+		root:      root,
+	}
+}
+
+// Returns the staged info of a wallet, or the stored one if it wasn't changed
+func (s *BalanceState) GetWalletInfo(wallet string) (WalletInfo, error) {
+	if info, ok := s.changes[wallet]; ok {
+		return info, nil
+	}
+
+	var info WalletInfo
+
+	val, err := s.bc.Balances.Get([]byte(wallet), nil)
+	if err == leveldb.ErrNotFound {
+		return info, nil
+	}
+
+	if err != nil {
+		return info, err
+	}
+
+	err = bson.Unmarshal(val, &info)
+	return info, err
+}
+
+// Given a wallet returns balance, nonce and burn
+func (s *BalanceState) GetBalance(wallet string) (coin.Amount, int, coin.Amount, error) {
+	info, err := s.GetWalletInfo(wallet)
+	return info.Balance, info.Nonce, info.Burn, err
+}
+
+// Stages amount, nonce, and burn for a given wallet
+func (s *BalanceState) SetBalance(wallet string, amount coin.Amount, nonce int, burn coin.Amount) error {
+	info, err := s.GetWalletInfo(wallet)
+	if err != nil {
+		return err
+	}
+
+	info.Balance = amount
+	info.Nonce = nonce
+	info.Burn = burn
+
+	s.stage(wallet, info)
+	return nil
+}
+
+// Stages the new info of a wallet, the state root has to be computed again
+func (s *BalanceState) stage(wallet string, info WalletInfo) {
+	s.changes[wallet] = info
+	s.tree = nil
+}
+
+// Adds amount to the balance of a wallet
+func (s *BalanceState) credit(wallet string, amount coin.Amount) error {
+	info, err := s.GetWalletInfo(wallet)
+	if err != nil {
+		return err
+	}
+
+	info.Balance, err = info.Balance.Add(amount)
+	if err != nil {
+		return err
+	}
+
+	s.stage(wallet, info)
+	return nil
+}
+
+// Applies all transactions and the reward of a block to the state
+func (s *BalanceState) ApplyBlock(curr *Block) error {
+	var totalGas coin.Amount
+	s.height = curr.Index
+	s.timestamp = curr.Timestamp
+
+	// The genesis block has no transactions or reward, only allocations
+	if curr.Index == 0 {
+		for _, v := range params.Active.Allocations {
+			err := s.credit(v.Address, v.Amount)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	transactions, err := DecodeTransactions(curr.TransactionList)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range transactions {
+		fee, err := s.ApplyTransaction(v)
+		if err != nil {
+			return errors.New("Transaction " + strconv.Itoa(k) + " is invalid: " + err.Error())
+		}
+
+		totalGas, err = totalGas.Add(fee)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Give the reward for having mined the block.
+	reward, err := GetReward(5)
+	if err != nil {
+		return err
+	}
+
+	reward, err = reward.Add(totalGas)
+	if err != nil {
+		return err
+	}
+
+	return s.credit(curr.Miner, reward)
+}
+
+// Moves the funds of a transaction and returns the gas it paid
+func (s *BalanceState) ApplyTransaction(v wallet.Transaction) (coin.Amount, error) {
+	err := VerifyTransaction(v)
+	if err != nil {
+		return 0, err
+	}
+
+	err = CheckLock(v, s.height, s.timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	sender := wallet.BytesToAddress(v.Sender)
+	info, err := s.GetWalletInfo(sender)
+	if err != nil {
+		return 0, err
+	}
+
+	// Every signed transaction can only be used once
+	err = CheckNonce(v.SenderNonce, info.Nonce)
+	if err != nil {
+		return 0, err
+	}
+
+	spent, err := v.Amount.Add(v.Gas)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check if balance is enough to complete the transaction
+	if spent > info.Balance {
+		return 0, errors.New("Balance is too low")
+	}
+
+	// Check if the transaction is for the Proof of burn addr, if it is then add burn.
+	// Older burns are decayed first, this way only one height has to be stored.
+	if v.Recipient == wallet.BurnAddress() {
+		info.Burn, err = info.GetBurnAt(s.height).Add(v.Amount)
+		if err != nil {
+			return 0, err
+		}
+
+		info.BurnHeight = s.height
+	}
+
+	info.Balance, err = info.Balance.Sub(spent)
+	if err != nil {
+		return 0, err
+	}
+
+	info.Nonce = v.SenderNonce
+	s.stage(sender, info)
+
+	// As there was no new transaction on the recivers part the nonce doesn't change
+	err = s.credit(v.Recipient, v.Amount)
+	if err != nil {
+		return 0, err
+	}
+
+	return v.Gas, nil
+}
+
+// Writes all staged changes with a single batch. The previous values are
+// stored as the undo record of the block with the given hash first.
+func (s *BalanceState) Commit(hash string) error {
+	// Sort wallets so that the undo record is the same on every node
+	wallets := []string{}
+	for k := range s.changes {
+		wallets = append(wallets, k)
+	}
+	sort.Strings(wallets)
+
+	var undo BlockUndo
+	for _, k := range wallets {
+		old, err := s.bc.Balances.Get([]byte(k), nil)
+		if err == leveldb.ErrNotFound {
+			old, err = nil, nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		undo.Entries = append(undo.Entries, UndoEntry{
+			Wallet: k,
+			Value:  old,
+		})
+	}
+
+	// If the node crashes after this the undo record just restores the
+	// values that are still in the database.
+	err := s.bc.storeUndo(hash, undo)
+	if err != nil {
+		return err
+	}
+
+	return s.write()
+}
+
+// Writes the new tree nodes to state.db, then the staged changes and the
+// state root to balances.db in a single batch
+func (s *BalanceState) write() error {
+	_, err := s.StateRoot()
+	if err != nil {
+		return err
+	}
+
+	err = s.tree.commit()
+	if err != nil {
+		return err
+	}
+
+	// The root moves together with the wallets it commits to
+	batch := new(leveldb.Batch)
+	for k, v := range s.changes {
+		data, err := bson.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		batch.Put([]byte(k), data)
+	}
+
+	batch.Put(stateRootKey, s.tree.root)
+	return s.bc.Balances.Write(batch, nil)
+}
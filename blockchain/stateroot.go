@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"bytes"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The state root is the root of the state tree, where every leaf is the
+// encoding of an AccountLeaf. This way a proof also shows the balance,
+// nonce and burn of the wallet.
+type AccountLeaf struct {
+	Wallet string     `bson:"w" json:"wallet"`
+	Info   WalletInfo `bson:"i" json:"info"`
+}
+
+// Proves the state of a wallet against a state root. Siblings are the
+// hashes next to the path of the wallet, starting from the root. If the
+// wallet isn't in the state Missing is set, and if its path ends with the
+// leaf of another wallet OtherKey and OtherValue are the key and value
+// hash of that leaf.
+type AccountProof struct {
+	Account    AccountLeaf `bson:"a" json:"account"`
+	Root       []byte      `bson:"r" json:"root"`
+	Siblings   [][]byte    `bson:"s" json:"siblings"`
+	Missing    bool        `bson:"m,omitempty" json:"missing,omitempty"`
+	OtherKey   []byte      `bson:"k,omitempty" json:"otherKey,omitempty"`
+	OtherValue []byte      `bson:"v,omitempty" json:"otherValue,omitempty"`
+}
+
+func (a AccountLeaf) getBytes() []byte {
+	encoded, _ := bson.Marshal(a)
+	return encoded
+}
+
+// Computes the state root as it would be after committing. Only the
+// changed wallets are written in the tree, and the tree is kept until more
+// changes are staged.
+func (s *BalanceState) StateRoot() ([]byte, error) {
+	if s.tree != nil {
+		return s.tree.root, nil
+	}
+
+	accounts := []AccountLeaf{}
+	for k, v := range s.changes {
+		accounts = append(accounts, AccountLeaf{Wallet: k, Info: v})
+	}
+
+	tree := newStateTree(s.bc.State, s.root)
+	err := tree.set(accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tree = tree
+	return tree.root, nil
+}
+
+// Returns the state root of the balances database
+func (bc *BlockChain) GetStateRoot() ([]byte, error) {
+	return readStateRoot(bc.Balances)
+}
+
+// Builds a proof of the current state of a wallet, or a proof that the
+// wallet isn't in the state
+func (bc *BlockChain) GetAccountProof(wallet string) (*AccountProof, error) {
+	root, err := bc.GetStateRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	return newStateTree(bc.State, root).prove(root, wallet)
+}
+
+// Returns all wallets in the state with the given root sorted by address
+func (bc *BlockChain) GetAccounts(root []byte) ([]AccountLeaf, error) {
+	accounts := []AccountLeaf{}
+
+	err := newStateTree(bc.State, root).walk(root, func(account AccountLeaf) error {
+		accounts = append(accounts, account)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Wallet < accounts[j].Wallet
+	})
+
+	return accounts, nil
+}
+
+// Checks that an account proof is valid for a given state root
+func VerifyAccountProof(proof *AccountProof, root []byte) bool {
+	if !bytes.Equal(proof.Root, root) || len(proof.Siblings) > len(emptyNode)*8 {
+		return false
+	}
+
+	key := stateKey(proof.Account.Wallet)
+	depth := len(proof.Siblings)
+
+	var node []byte
+	switch {
+	case !proof.Missing:
+		node = leafHash(key, valueHash(proof.Account.getBytes()))
+
+	case proof.Account.Info != WalletInfo{}:
+		return false
+
+	case proof.OtherKey != nil:
+		// The other wallet has to share the path up to its leaf
+		if len(proof.OtherKey) != len(key) || len(proof.OtherValue) != len(emptyNode) || bytes.Equal(proof.OtherKey, key) {
+			return false
+		}
+
+		for i := 0; i < depth; i++ {
+			if keyBit(proof.OtherKey, i) != keyBit(key, i) {
+				return false
+			}
+		}
+
+		node = leafHash(proof.OtherKey, proof.OtherValue)
+
+	default:
+		node = emptyNode
+	}
+
+	for i := depth - 1; i >= 0; i-- {
+		if keyBit(key, i) == 0 {
+			node = internalHash(node, proof.Siblings[i])
+		} else {
+			node = internalHash(proof.Siblings[i], node)
+		}
+	}
+
+	return bytes.Equal(node, root)
+}
@@ -0,0 +1,328 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+
+	"github.com/minio/blake2b-simd"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+The state is a sparse merkle tree with a leaf for every possible wallet,
+the path of a wallet is the blake2b hash of its address. Empty subtrees
+hash to 32 zero bytes and a subtree with a single wallet is replaced by the
+leaf of that wallet, so paths are only as long as needed to tell the
+wallets apart.
+
+	leaf     = blake2b(0x00 + key + blake2b(AccountLeaf))
+	internal = blake2b(0x01 + left + right)
+
+Layout of state.db:
+
+	node hash -> 0x00 + key + AccountLeaf, or 0x01 + left + right
+
+The root of the tree is kept in balances.db under the root key, next to the
+wallets it commits to, so both are always written together.
+
+Nodes are never removed, wallets don't leave the state and older roots stay
+readable, this way the state committed by any block can be inspected.
+*/
+const (
+	leafNode     = 0x00
+	internalNode = 0x01
+)
+
+var (
+	emptyNode    = make([]byte, 32)
+	stateRootKey = []byte("root")
+)
+
+// A wallet to write in the tree
+type treeLeaf struct {
+	key     []byte
+	account []byte
+}
+
+func newTreeLeaf(account AccountLeaf) treeLeaf {
+	return treeLeaf{key: stateKey(account.Wallet), account: account.getBytes()}
+}
+
+// Returns the path of a wallet in the tree
+func stateKey(wallet string) []byte {
+	hash := blake2b.Sum256([]byte(wallet))
+	return hash[:]
+}
+
+// Returns bit i of a key, starting from the most significant one
+func keyBit(key []byte, i int) byte {
+	return (key[i/8] >> uint(7-i%8)) & 1
+}
+
+func leafHash(key, valueHash []byte) []byte {
+	data := append([]byte{leafNode}, key...)
+	hash := blake2b.Sum256(append(data, valueHash...))
+	return hash[:]
+}
+
+func internalHash(left, right []byte) []byte {
+	data := append([]byte{internalNode}, left...)
+	hash := blake2b.Sum256(append(data, right...))
+	return hash[:]
+}
+
+func valueHash(account []byte) []byte {
+	hash := blake2b.Sum256(account)
+	return hash[:]
+}
+
+// Returns the hash of an encoded node
+func nodeHash(node []byte) []byte {
+	if node[0] == leafNode {
+		return leafHash(node[1:33], valueHash(node[33:]))
+	}
+
+	return internalHash(node[1:33], node[33:65])
+}
+
+// Reads nodes from state.db and keeps the new ones in memory until they
+// are written. Without a database the tree starts empty.
+type stateTree struct {
+	db    *leveldb.DB
+	nodes map[string][]byte
+	root  []byte
+}
+
+func newStateTree(db *leveldb.DB, root []byte) *stateTree {
+	return &stateTree{
+		db:    db,
+		nodes: make(map[string][]byte),
+		root:  root,
+	}
+}
+
+// Returns the state root stored in a balances database
+func readStateRoot(db *leveldb.DB) ([]byte, error) {
+	root, err := db.Get(stateRootKey, nil)
+	if err == leveldb.ErrNotFound {
+		return emptyNode, nil
+	}
+
+	return root, err
+}
+
+// Writes wallets in the tree and moves its root
+func (t *stateTree) set(accounts []AccountLeaf) error {
+	leaves := []treeLeaf{}
+	for _, v := range accounts {
+		leaves = append(leaves, newTreeLeaf(v))
+	}
+
+	root, err := t.update(t.root, 0, leaves)
+	if err != nil {
+		return err
+	}
+
+	t.root = root
+	return nil
+}
+
+func (t *stateTree) getNode(hash []byte) ([]byte, error) {
+	if node, ok := t.nodes[string(hash)]; ok {
+		return node, nil
+	}
+
+	if t.db != nil {
+		node, err := t.db.Get(hash, nil)
+		if err == nil && len(node) > 33 {
+			return node, nil
+		}
+
+		if err != nil && err != leveldb.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("State node " + hex.EncodeToString(hash) + " is missing")
+}
+
+func (t *stateTree) putNode(node []byte) []byte {
+	hash := nodeHash(node)
+	t.nodes[string(hash)] = node
+	return hash
+}
+
+// Writes the leaves in the subtree with the given root at depth and
+// returns the new root of the subtree. Leaves have to be different
+// wallets.
+func (t *stateTree) update(root []byte, depth int, leaves []treeLeaf) ([]byte, error) {
+	if len(leaves) == 0 {
+		return root, nil
+	}
+
+	if bytes.Equal(root, emptyNode) {
+		return t.build(depth, leaves), nil
+	}
+
+	node, err := t.getNode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// A leaf has to move down next to the new ones, unless it's replaced
+	if node[0] == leafNode {
+		key := node[1:33]
+		for _, v := range leaves {
+			if bytes.Equal(v.key, key) {
+				return t.build(depth, leaves), nil
+			}
+		}
+
+		old := treeLeaf{key: key, account: node[33:]}
+		return t.build(depth, append(append([]treeLeaf{}, leaves...), old)), nil
+	}
+
+	left, right := splitLeaves(leaves, depth)
+
+	newLeft, err := t.update(node[1:33], depth+1, left)
+	if err != nil {
+		return nil, err
+	}
+
+	newRight, err := t.update(node[33:65], depth+1, right)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.putNode(internalNodeData(newLeft, newRight)), nil
+}
+
+// Builds a subtree that only contains the given leaves
+func (t *stateTree) build(depth int, leaves []treeLeaf) []byte {
+	if len(leaves) == 0 {
+		return emptyNode
+	}
+
+	if len(leaves) == 1 {
+		node := append([]byte{leafNode}, leaves[0].key...)
+		return t.putNode(append(node, leaves[0].account...))
+	}
+
+	left, right := splitLeaves(leaves, depth)
+	return t.putNode(internalNodeData(t.build(depth+1, left), t.build(depth+1, right)))
+}
+
+func internalNodeData(left, right []byte) []byte {
+	node := append([]byte{internalNode}, left...)
+	return append(node, right...)
+}
+
+func splitLeaves(leaves []treeLeaf, depth int) (left, right []treeLeaf) {
+	for _, v := range leaves {
+		if keyBit(v.key, depth) == 0 {
+			left = append(left, v)
+		} else {
+			right = append(right, v)
+		}
+	}
+
+	return left, right
+}
+
+// Calls fn with every wallet in the subtree with the given root
+func (t *stateTree) walk(root []byte, fn func(AccountLeaf) error) error {
+	if bytes.Equal(root, emptyNode) {
+		return nil
+	}
+
+	node, err := t.getNode(root)
+	if err != nil {
+		return err
+	}
+
+	if node[0] == leafNode {
+		var account AccountLeaf
+		err = bson.Unmarshal(node[33:], &account)
+		if err != nil {
+			return err
+		}
+
+		return fn(account)
+	}
+
+	err = t.walk(node[1:33], fn)
+	if err != nil {
+		return err
+	}
+
+	return t.walk(node[33:65], fn)
+}
+
+// Builds a proof that a wallet is or isn't in the tree with the given root
+func (t *stateTree) prove(root []byte, wallet string) (*AccountProof, error) {
+	key := stateKey(wallet)
+	proof := &AccountProof{
+		Account:  AccountLeaf{Wallet: wallet},
+		Root:     root,
+		Siblings: [][]byte{},
+	}
+
+	curr := root
+	for depth := 0; ; depth++ {
+		if bytes.Equal(curr, emptyNode) {
+			proof.Missing = true
+			return proof, nil
+		}
+
+		node, err := t.getNode(curr)
+		if err != nil {
+			return nil, err
+		}
+
+		if node[0] == leafNode {
+			if !bytes.Equal(node[1:33], key) {
+				proof.Missing = true
+				proof.OtherKey = node[1:33]
+				proof.OtherValue = valueHash(node[33:])
+				return proof, nil
+			}
+
+			err = bson.Unmarshal(node[33:], &proof.Account)
+			return proof, err
+		}
+
+		if keyBit(key, depth) == 0 {
+			proof.Siblings = append(proof.Siblings, node[33:65])
+			curr = node[1:33]
+		} else {
+			proof.Siblings = append(proof.Siblings, node[1:33])
+			curr = node[33:65]
+		}
+	}
+}
+
+// Writes the new nodes. Nodes are addressed by their hash, so writing them
+// before the root moves is always safe.
+func (t *stateTree) commit() error {
+	batch := new(leveldb.Batch)
+	for k, v := range t.nodes {
+		batch.Put([]byte(k), v)
+	}
+
+	return t.db.Write(batch, nil)
+}
+
+// Advances an iterator over a balances database to the next wallet,
+// skipping the state root
+func nextWallet(iter iterator.Iterator) bool {
+	for iter.Next() {
+		if !bytes.Equal(iter.Key(), stateRootKey) {
+			return true
+		}
+	}
+
+	return false
+}
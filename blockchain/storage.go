@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+/*
+Layout of blockchain.db:
+
+	blk + hash            -> PoWBlock, for every known block
+	wrk + hash            -> total work of the branch ending with the block
+	und + hash            -> undo record of a processed block
+	hgt + 8 byte height   -> hash of the main chain block at that height
+	idx + hash            -> 8 byte height, only for main chain blocks
+	chd + parent + hash   -> empty, for every known block but the genesis
+	tip                   -> hash of the last main chain block
+	ver                   -> layout version
+
+Heights are big endian, this way iterating keys returns the chain in order.
+*/
+var (
+	blockPrefix  = []byte("blk")
+	workPrefix   = []byte("wrk")
+	undoPrefix   = []byte("und")
+	heightPrefix = []byte("hgt")
+	indexPrefix  = []byte("idx")
+	childPrefix  = []byte("chd")
+	tipKey       = []byte("tip")
+	versionKey   = []byte("ver")
+)
+
+const STORAGE_VERSION = 1
+
+func prefixedKey(prefix []byte, hash string) []byte {
+	return append(append([]byte{}, prefix...), hash...)
+}
+
+func encodeInt64(value int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(value))
+	return buf
+}
+
+func childKey(parent, hash string) []byte {
+	return append(prefixedKey(childPrefix, parent), hash...)
+}
+
+func heightKey(height int64) []byte {
+	return append(append([]byte{}, heightPrefix...), encodeInt64(height)...)
+}
+
+// Returns the height of a block on the main chain
+func (bc *BlockChain) GetBlockHeight(hash string) (int64, error) {
+	data, err := bc.DB.Get(prefixedKey(indexPrefix, hash), nil)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(data) != 8 {
+		return -1, errors.New("Corrupted height index")
+	}
+
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+// Checks if a block is part of the main chain
+func (bc *BlockChain) IsMainChain(hash string) bool {
+	_, err := bc.GetBlockHeight(hash)
+	return err == nil
+}
+
+// Returns the hash of the main chain block at a given height
+func (bc *BlockChain) GetHashAtHeight(height int64) (string, error) {
+	hash, err := bc.DB.Get(heightKey(height), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Checks if the database was made by a version with a different layout.
+// Empty databases are fine, they get initialized by OpenBlockchain.
+func checkStorageVersion(db *leveldb.DB) error {
+	version, err := db.Get(versionKey, nil)
+	if err == nil {
+		if len(version) != 8 || binary.BigEndian.Uint64(version) != STORAGE_VERSION {
+			return errors.New("Unknown blockchain.db layout")
+		}
+
+		return nil
+	}
+
+	iter := db.NewIterator(nil, nil)
+	empty := !iter.Next()
+	iter.Release()
+
+	if !empty {
+		return errors.New("blockchain.db uses an old layout, resync required: delete the data directory and download the chain again")
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+Layout of index.db, only main chain blocks are indexed:
+
+	tx + txid                                  -> 8 byte height + 4 byte position
+	adr + address + 0 + height + position      -> role + txid, or role + block hash if mined
+	tip                                        -> hash of the last indexed block
+
+Addresses are Base58 so they never contain a 0 byte, this way the entries of
+an address are sorted by height and position.
+*/
+var (
+	txIndexPrefix      = []byte("tx")
+	addressIndexPrefix = []byte("adr")
+	indexTipKey        = []byte("tip")
+)
+
+// How an address took part in a transaction
+const (
+	ROLE_SENT     = 1
+	ROLE_RECEIVED = 2
+	ROLE_MINED    = 3
+	ROLE_BURNED   = 4
+)
+
+var RoleNames = map[byte]string{
+	ROLE_SENT:     "sent",
+	ROLE_RECEIVED: "received",
+	ROLE_MINED:    "mined",
+	ROLE_BURNED:   "burned",
+}
+
+// The reward of a block is indexed after all its transactions
+const MINED_POSITION = math.MaxUint32
+
+// An entry in the history of an address
+type IndexEntry struct {
+	Height   int64
+	Position uint32
+	Role     byte
+
+	// Transaction id, or hash of the block for ROLE_MINED
+	Id []byte
+}
+
+// Opens index.db if indexes are enabled for this process. Indexes built up
+// to another block than the tip, for example because they were disabled
+// for a while, aren't used until reindex is run.
+func (bc *BlockChain) openIndex() *leveldb.DB {
+	if !params.TxIndex {
+		return nil
+	}
+
+	db := openIndexFile()
+
+	indexed, err := db.Get(indexTipKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		log.Fatal(err)
+	}
+
+	tip, err := bc.DB.Get(tipKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		log.Fatal(err)
+	}
+
+	if !bytes.Equal(indexed, tip) {
+		log.Error("Indexes don't match the tip of the chain, run reindex to use them")
+		db.Close()
+		return nil
+	}
+
+	return db
+}
+
+func openIndexFile() *leveldb.DB {
+	db, err := leveldb.OpenFile(params.GetPath("index.db"), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db
+}
+
+func txIndexKey(txid []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txid...)
+}
+
+func addressIndexPrefixKey(address string) []byte {
+	key := append(append([]byte{}, addressIndexPrefix...), address...)
+	return append(key, 0)
+}
+
+func location(height int64, position uint32) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf, uint64(height))
+	binary.BigEndian.PutUint32(buf[8:], position)
+	return buf
+}
+
+func addressIndexKey(address string, height int64, position uint32) []byte {
+	return append(addressIndexPrefixKey(address), location(height, position)...)
+}
+
+// Adds or removes the entries of a block from the indexes
+func (bc *BlockChain) updateIndex(b *Block, remove bool) error {
+	if bc.Index == nil {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	if remove {
+		batch.Put(indexTipKey, []byte(b.PreviousBlockHash))
+	} else {
+		batch.Put(indexTipKey, []byte(b.Hash))
+	}
+
+	// The genesis only moves the tip of the indexes
+	if b.Index == 0 {
+		return bc.Index.Write(batch, nil)
+	}
+
+	transactions, err := DecodeTransactions(b.TransactionList)
+	if err != nil {
+		return err
+	}
+
+	put := func(key, value []byte) {
+		if remove {
+			batch.Delete(key)
+		} else {
+			batch.Put(key, value)
+		}
+	}
+
+	for k, v := range transactions {
+		txid := v.GetHash()
+		pos := uint32(k)
+		put(txIndexKey(txid), location(b.Index, pos))
+
+		senderRole := byte(ROLE_SENT)
+		if v.Recipient == wallet.BurnAddress() {
+			senderRole = ROLE_BURNED
+		} else {
+			put(addressIndexKey(v.Recipient, b.Index, pos), append([]byte{ROLE_RECEIVED}, txid...))
+		}
+
+		sender := wallet.BytesToAddress(v.Sender)
+		put(addressIndexKey(sender, b.Index, pos), append([]byte{senderRole}, txid...))
+	}
+
+	put(addressIndexKey(b.Miner, b.Index, MINED_POSITION), append([]byte{ROLE_MINED}, b.Hash...))
+
+	return bc.Index.Write(batch, nil)
+}
+
+// Updates the indexes for a block that was applied or disconnected.
+// Indexes don't affect consensus, so if they can't be updated they are
+// dropped until reindex is run.
+func (bc *BlockChain) indexBlock(b *Block, remove bool) {
+	err := bc.updateIndex(b, remove)
+	if err == nil {
+		return
+	}
+
+	log.Error("Indexes disabled, run reindex to use them again: ", err)
+
+	bc.Index.Delete(indexTipKey, nil)
+	bc.Index.Close()
+	bc.Index = nil
+}
+
+// Returns the height and position in the block of a transaction
+func (bc *BlockChain) GetTransactionLocation(txid []byte) (int64, uint32, error) {
+	if bc.Index == nil {
+		return 0, 0, errors.New("Indexes are disabled")
+	}
+
+	data, err := bc.Index.Get(txIndexKey(txid), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(data) != 12 {
+		return 0, 0, errors.New("Corrupted transaction index")
+	}
+
+	return int64(binary.BigEndian.Uint64(data)), binary.BigEndian.Uint32(data[8:]), nil
+}
+
+// Finds a main chain transaction using the index
+func (bc *BlockChain) GetTransaction(txid []byte) (*wallet.Transaction, *Block, error) {
+	height, pos, err := bc.GetTransactionLocation(txid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := bc.GetBlock(height)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transactions, err := DecodeTransactions(b.TransactionList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if int(pos) >= len(transactions) {
+		return nil, nil, errors.New("Corrupted transaction index")
+	}
+
+	return &transactions[pos], b, nil
+}
+
+// Returns up to max entries from the history of an address, newest first
+func (bc *BlockChain) GetAddressHistory(address string, max int) ([]IndexEntry, error) {
+	if bc.Index == nil {
+		return nil, errors.New("Indexes are disabled")
+	}
+
+	prefix := addressIndexPrefixKey(address)
+	result := []IndexEntry{}
+
+	iter := bc.Index.NewIterator(util.BytesPrefix(prefix), nil)
+	for ok := iter.Last(); ok && len(result) < max; ok = iter.Prev() {
+		key := iter.Key()[len(prefix):]
+		value := iter.Value()
+
+		if len(key) != 12 || len(value) == 0 {
+			iter.Release()
+			return nil, errors.New("Corrupted address index")
+		}
+
+		result = append(result, IndexEntry{
+			Height:   int64(binary.BigEndian.Uint64(key)),
+			Position: binary.BigEndian.Uint32(key[8:]),
+			Role:     value[0],
+			Id:       append([]byte{}, value[1:]...),
+		})
+	}
+	iter.Release()
+
+	return result, iter.Error()
+}
+
+// Deletes the indexes and builds them again from the main chain
+func (bc *BlockChain) Reindex() error {
+	if !params.TxIndex {
+		return errors.New("Indexes are disabled")
+	}
+
+	// Indexes that don't match the tip were not opened
+	if bc.Index == nil {
+		bc.Index = openIndexFile()
+	}
+
+	batch := new(leveldb.Batch)
+	iter := bc.Index.NewIterator(nil, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+
+	err := bc.Index.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	length := bc.GetLen()
+	for i := int64(0); i < length; i++ {
+		b, err := bc.GetBlock(i)
+		if err != nil {
+			return err
+		}
+
+		err = bc.updateIndex(b, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Value of a wallet before a block changed it. Value is nil if the
+// wallet wasn't in the balances database.
+type UndoEntry struct {
+	Wallet string `bson:"w"`
+	Value  []byte `bson:"v,omitempty"`
+}
+
+// Everything needed to disconnect a block from the balances database
+type BlockUndo struct {
+	Entries []UndoEntry `bson:"e"`
+}
+
+// Stores the undo record of a processed block
+func (bc *BlockChain) storeUndo(hash string, undo BlockUndo) error {
+	encoded, err := bson.Marshal(undo)
+	if err != nil {
+		return err
+	}
+
+	return bc.DB.Put(prefixedKey(undoPrefix, hash), encoded, nil)
+}
+
+// Returns the undo record of a block
+func (bc *BlockChain) GetUndo(hash string) (*BlockUndo, error) {
+	data, err := bc.DB.Get(prefixedKey(undoPrefix, hash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var undo BlockUndo
+	err = bson.Unmarshal(data, &undo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &undo, nil
+}
+
+// Restores all balances to the state they had before the block was
+// processed. The block has to be the last one applied.
+func (bc *BlockChain) DisconnectBlock(b *Block) error {
+	undo, err := bc.GetUndo(b.Hash)
+	if err != nil {
+		return errors.New("No undo record for block: " + err.Error())
+	}
+
+	// The tree still has the nodes of the state the parent committed to
+	parent, err := bc.GetBlockByHash(b.PreviousBlockHash)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, v := range undo.Entries {
+		if v.Value == nil {
+			batch.Delete([]byte(v.Wallet))
+		} else {
+			batch.Put([]byte(v.Wallet), v.Value)
+		}
+	}
+
+	batch.Put(stateRootKey, parent.StateRoot)
+	err = bc.Balances.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	bc.indexBlock(b, true)
+
+	return bc.DB.Delete(prefixedKey(undoPrefix, b.Hash), nil)
+}
+
+// Removes the last blocks from the main chain and restores balances.
+// Removed blocks are forgotten, this way they can be downloaded again.
+func (bc *BlockChain) Rollback(blocks int64) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	for i := int64(0); i < blocks; i++ {
+		tip, err := bc.GetPoWBlock(bc.GetLen() - 1)
+		if err != nil {
+			return err
+		}
+
+		if tip.MinedBlock.Index == 0 {
+			return errors.New("The genesis block can't be rolled back")
+		}
+
+		err = bc.DisconnectBlock(tip.MinedBlock)
+		if err != nil {
+			return err
+		}
+
+		batch := new(leveldb.Batch)
+		batch.Delete(heightKey(tip.MinedBlock.Index))
+		batch.Delete(prefixedKey(indexPrefix, tip.MinedBlock.Hash))
+		batch.Put(tipKey, []byte(tip.MinedBlock.PreviousBlockHash))
+
+		err = bc.DB.Write(batch, nil)
+		if err != nil {
+			return err
+		}
+
+		bc.forgetBlocks([]*PoWBlock{tip})
+
+		log.Info("Rolled back block ", tip.MinedBlock.Index)
+	}
+
+	return nil
+}
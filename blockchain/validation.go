@@ -0,0 +1,211 @@
+package blockchain
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/badlamb/dexm/wallet"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Maximum size of an encoded PoWBlock in bytes
+	MAX_BLOCK_SIZE = 1024 * 1024
+
+	// A block can't be further than this in the future, in seconds
+	MAX_FUTURE_BLOCK_TIME = 2 * 60 * 60
+
+	// How many blocks are used to compute the median time past
+	MEDIAN_TIME_BLOCKS = 11
+)
+
+// Consensus rules a block can break
+const (
+	RULE_MISSING_BLOCK = "missing-block"
+	RULE_KNOWN_BLOCK   = "known-block"
+	RULE_ORPHAN        = "orphan"
+	RULE_INDEX         = "index"
+	RULE_HASH          = "hash"
+	RULE_MINER         = "miner"
+	RULE_SIZE          = "size"
+	RULE_TIMESTAMP     = "timestamp"
+	RULE_MERKLE_ROOT   = "merkle-root"
+	RULE_DIFFICULTY    = "difficulty"
+	RULE_POW           = "pow"
+	RULE_DUPLICATE_TX  = "duplicate-transaction"
+	RULE_BLOCK_GAS     = "block-gas"
+	RULE_TRANSACTIONS  = "transactions"
+	RULE_STATE_ROOT    = "state-root"
+)
+
+// Returned when a block is rejected, Rule is the rule it broke
+type BlockValidationError struct {
+	Rule    string
+	Message string
+}
+
+func (e *BlockValidationError) Error() string {
+	return "Invalid block (" + e.Rule + "): " + e.Message
+}
+
+func invalidBlock(rule, message string) error {
+	return &BlockValidationError{Rule: rule, Message: message}
+}
+
+// Returns the median timestamp of the last MEDIAN_TIME_BLOCKS blocks ending
+// with the block with the given hash.
+func (bc *BlockChain) GetMedianTimePast(hash string) (int64, error) {
+	timestamps := []int64{}
+
+	for len(timestamps) < MEDIAN_TIME_BLOCKS {
+		curr, err := bc.GetBlockByHash(hash)
+		if err != nil {
+			return 0, err
+		}
+
+		timestamps = append(timestamps, curr.Timestamp)
+		if curr.Index == 0 {
+			break
+		}
+
+		hash = curr.PreviousBlockHash
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	return timestamps[len(timestamps)/2], nil
+}
+
+// Verify that a PoW block is valid. The block has to extend a known
+// block, but not necessarily the tip of the main chain. Blocks that break
+// a rule are rejected with a *BlockValidationError.
+func (bc *BlockChain) VerifyNewBlockValidity(minedBlock *PoWBlock) (bool, error) {
+	if minedBlock.MinedBlock == nil {
+		return false, invalidBlock(RULE_MISSING_BLOCK, "Block is missing")
+	}
+
+	newBlock := minedBlock.MinedBlock
+
+	if bc.HasBlock(newBlock.Hash) {
+		return false, invalidBlock(RULE_KNOWN_BLOCK, "Block is already known")
+	}
+
+	parent, err := bc.GetBlockByHash(newBlock.PreviousBlockHash)
+	if err != nil {
+		return false, invalidBlock(RULE_ORPHAN, "Previous block is unknown")
+	}
+
+	// Only checked on arrival, stored blocks stay valid as time passes
+	if newBlock.Timestamp > time.Now().Unix()+MAX_FUTURE_BLOCK_TIME {
+		return false, invalidBlock(RULE_TIMESTAMP, "Block is too far in the future")
+	}
+
+	transactions, err := bc.checkBlock(minedBlock, parent)
+	if err != nil {
+		return false, err
+	}
+
+	// Balances and the state root are checked once, when ProcessBlock
+	// applies the block to the main chain
+	for k, v := range transactions {
+		err := VerifyTransaction(v)
+		if err == nil {
+			err = CheckLock(v, newBlock.Index, newBlock.Timestamp)
+		}
+
+		if err != nil {
+			return false, invalidBlock(RULE_TRANSACTIONS, "Transaction "+strconv.Itoa(k)+" is invalid: "+err.Error())
+		}
+	}
+
+	return true, nil
+}
+
+// Checks the rules that only depend on the block and its ancestors, these
+// are the same for new blocks and for blocks already in the main chain.
+// Returns the decoded transactions.
+func (bc *BlockChain) checkBlock(minedBlock *PoWBlock, parent *Block) ([]wallet.Transaction, error) {
+	newBlock := minedBlock.MinedBlock
+
+	if newBlock.Index != parent.Index+1 {
+		return nil, invalidBlock(RULE_INDEX, "Block index is not correct")
+	}
+
+	if newBlock.Hash != newBlock.CalculateHash() {
+		return nil, invalidBlock(RULE_HASH, "Block hash is not correct")
+	}
+
+	err := wallet.ValidateAddress(newBlock.Miner)
+	if err != nil {
+		return nil, invalidBlock(RULE_MINER, err.Error())
+	}
+
+	encoded, err := bson.Marshal(minedBlock)
+	if err != nil {
+		return nil, invalidBlock(RULE_SIZE, err.Error())
+	}
+
+	if len(encoded) > MAX_BLOCK_SIZE {
+		return nil, invalidBlock(RULE_SIZE, "Block is "+strconv.Itoa(len(encoded))+" bytes")
+	}
+
+	medianTime, err := bc.GetMedianTimePast(parent.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if newBlock.Timestamp <= medianTime {
+		return nil, invalidBlock(RULE_TIMESTAMP, "Block is older than the median time past")
+	}
+
+	difficulty, err := newBlock.GetDifficulty(bc)
+	if err != nil {
+		return nil, err
+	}
+
+	if difficulty.Cmp(newBlock.GetHeaderDifficulty()) != 0 {
+		return nil, invalidBlock(RULE_DIFFICULTY, "Block difficulty is not correct")
+	}
+
+	hash, err := minedBlock.GetPoWHash()
+	if err != nil {
+		return nil, invalidBlock(RULE_POW, err.Error())
+	}
+
+	if hash.Cmp(GetTarget(difficulty)) > 0 {
+		return nil, invalidBlock(RULE_POW, "Proof of work is not valid")
+	}
+
+	transactions, err := DecodeTransactions(newBlock.TransactionList)
+	if err != nil {
+		return nil, invalidBlock(RULE_TRANSACTIONS, err.Error())
+	}
+
+	ids := [][]byte{}
+	seen := make(map[string]bool)
+	gas := 0
+	for k, v := range transactions {
+		id := v.GetHash()
+		if seen[string(id)] {
+			return nil, invalidBlock(RULE_DUPLICATE_TX, "Transaction "+strconv.Itoa(k)+" is a duplicate")
+		}
+
+		seen[string(id)] = true
+		ids = append(ids, id)
+		gas += GetTransactionGas(v)
+	}
+
+	if gas > MAX_BLOCK_GAS {
+		return nil, invalidBlock(RULE_BLOCK_GAS, "Block uses "+strconv.Itoa(gas)+" gas")
+	}
+
+	if !bytes.Equal(MerkleRoot(ids), newBlock.MerkleRoot) {
+		return nil, invalidBlock(RULE_MERKLE_ROOT, "Merkle root is not correct")
+	}
+
+	return transactions, nil
+}
@@ -0,0 +1,183 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/badlamb/dexm/params"
+	"github.com/syndtr/goleveldb/leveldb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Result of VerifyChain. FirstBadBlock is -1 and DivergentAccount is empty
+// if no problem was found.
+type ChainReport struct {
+	Blocks        int64
+	FirstBadBlock int64
+	BlockError    string
+
+	Accounts         int
+	DivergentAccount string
+	AccountError     string
+}
+
+// Checks that blockchain.db and balances.db are consistent. Every main chain
+// block is checked again from the genesis, then balances are computed from
+// scratch in a temporary database and compared with the live ones. Only the
+// first problem is reported.
+func (bc *BlockChain) VerifyChain() (*ChainReport, error) {
+	report := &ChainReport{FirstBadBlock: -1}
+
+	dir, err := ioutil.TempDir("", "dexm-verify")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	balances, err := leveldb.OpenFile(filepath.Join(dir, "balances.db"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer balances.Close()
+
+	state, err := leveldb.OpenFile(filepath.Join(dir, "state.db"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer state.Close()
+
+	// Blocks are read from the live database, balances go to the new ones
+	scratch := &BlockChain{DB: bc.DB, Balances: balances, State: state}
+
+	length := bc.GetLen()
+	var parent *Block
+
+	for i := int64(0); i < length; i++ {
+		report.Blocks = i + 1
+
+		mined, err := bc.GetPoWBlock(i)
+		if err == nil {
+			err = bc.verifyStoredBlock(mined, parent, i)
+		}
+
+		if err == nil {
+			err = scratch.replayBlock(mined.MinedBlock)
+		}
+
+		if err != nil {
+			report.FirstBadBlock = i
+			report.BlockError = err.Error()
+			return report, nil
+		}
+
+		parent = mined.MinedBlock
+	}
+
+	return report, diffBalances(report, balances, bc.Balances)
+}
+
+// Checks a block of the main chain at height i
+func (bc *BlockChain) verifyStoredBlock(mined *PoWBlock, parent *Block, i int64) error {
+	b := mined.MinedBlock
+	if b == nil {
+		return errors.New("Block is missing")
+	}
+
+	if b.Index != i {
+		return errors.New("Block has index " + strconv.FormatInt(b.Index, 10))
+	}
+
+	if b.Hash != b.CalculateHash() {
+		return errors.New("Block hash is not correct")
+	}
+
+	height, err := bc.GetBlockHeight(b.Hash)
+	if err != nil || height != i {
+		return errors.New("Height index is not correct")
+	}
+
+	if i == 0 {
+		return VerifyGenesis(b, params.Active)
+	}
+
+	if b.PreviousBlockHash != parent.Hash {
+		return errors.New("Block doesn't link to the previous one")
+	}
+
+	_, err = bc.checkBlock(mined, parent)
+	return err
+}
+
+// Applies a block to the balances like ProcessBlock, without undo records
+// or indexes
+func (bc *BlockChain) replayBlock(b *Block) error {
+	state, err := bc.stageBlock(b)
+	if err != nil {
+		return err
+	}
+
+	return state.write()
+}
+
+// Compares the recomputed balances with the live ones. Both databases are
+// iterated in key order, so the first divergent account is the smallest.
+func diffBalances(report *ChainReport, expected, live *leveldb.DB) error {
+	exp := expected.NewIterator(nil, nil)
+	defer exp.Release()
+
+	act := live.NewIterator(nil, nil)
+	defer act.Release()
+
+	hasExp, hasAct := nextWallet(exp), nextWallet(act)
+	for hasExp || hasAct {
+		var cmp int
+		switch {
+		case !hasAct:
+			cmp = -1
+		case !hasExp:
+			cmp = 1
+		default:
+			cmp = bytes.Compare(exp.Key(), act.Key())
+		}
+
+		switch {
+		case cmp < 0:
+			report.DivergentAccount = string(exp.Key())
+			report.AccountError = "Account is missing from balances.db"
+			return nil
+		case cmp > 0:
+			report.DivergentAccount = string(act.Key())
+			report.AccountError = "Account shouldn't exist"
+			return nil
+		}
+
+		var want, have WalletInfo
+		err := bson.Unmarshal(exp.Value(), &want)
+		if err != nil {
+			return err
+		}
+
+		err = bson.Unmarshal(act.Value(), &have)
+		if err != nil || want != have {
+			report.DivergentAccount = string(act.Key())
+			report.AccountError = "Account has balance " + have.Balance.String() +
+				", nonce " + strconv.Itoa(have.Nonce) + " and burn " + have.Burn.String() +
+				" instead of " + want.Balance.String() + ", " + strconv.Itoa(want.Nonce) +
+				" and " + want.Burn.String()
+			return nil
+		}
+
+		report.Accounts++
+		hasExp, hasAct = nextWallet(exp), nextWallet(act)
+	}
+
+	if exp.Error() != nil {
+		return exp.Error()
+	}
+
+	return act.Error()
+}
@@ -0,0 +1,155 @@
+package coin
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount is a number of base units, COIN base units make one Dexm. It has
+// the same size on every platform. Amounts are never negative: Add, Sub and
+// Mul return an error instead of wrapping around or going below zero.
+type Amount int64
+
+const (
+	// Digits after the decimal point
+	DECIMALS = 8
+
+	// Base units in one Dexm
+	COIN Amount = 100000000
+
+	MAX_AMOUNT Amount = math.MaxInt64
+)
+
+var (
+	ErrOverflow = errors.New("Amount is too large")
+	ErrNegative = errors.New("Amount can't be negative")
+)
+
+// Returns a whole number of coins as an Amount
+func FromCoins(coins int64) (Amount, error) {
+	return COIN.Mul(coins)
+}
+
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a < 0 || b < 0 {
+		return 0, ErrNegative
+	}
+
+	if a > MAX_AMOUNT-b {
+		return 0, ErrOverflow
+	}
+
+	return a + b, nil
+}
+
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if a < 0 || b < 0 || b > a {
+		return 0, ErrNegative
+	}
+
+	return a - b, nil
+}
+
+func (a Amount) Mul(n int64) (Amount, error) {
+	if a < 0 || n < 0 {
+		return 0, ErrNegative
+	}
+
+	if n != 0 && a > MAX_AMOUNT/Amount(n) {
+		return 0, ErrOverflow
+	}
+
+	return a * Amount(n), nil
+}
+
+// Divides rounding down
+func (a Amount) Div(n int64) (Amount, error) {
+	if a < 0 || n < 0 {
+		return 0, ErrNegative
+	}
+
+	if n == 0 {
+		return 0, errors.New("Division by zero")
+	}
+
+	return a / Amount(n), nil
+}
+
+// Adds up all amounts
+func Sum(amounts ...Amount) (Amount, error) {
+	var total Amount
+	for _, v := range amounts {
+		var err error
+		total, err = total.Add(v)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// Formats the amount in Dexm, without trailing zeros
+func (a Amount) String() string {
+	sign := ""
+	units := uint64(a)
+	if a < 0 {
+		sign = "-"
+		units = uint64(-(a + 1)) + 1
+	}
+
+	whole := strconv.FormatUint(units/uint64(COIN), 10)
+	frac := units % uint64(COIN)
+	if frac == 0 {
+		return sign + whole
+	}
+
+	digits := strconv.FormatUint(frac, 10)
+	digits = strings.Repeat("0", DECIMALS-len(digits)) + digits
+
+	return sign + whole + "." + strings.TrimRight(digits, "0")
+}
+
+// Parses a decimal amount of Dexm like "12" or "0.5"
+func Parse(str string) (Amount, error) {
+	parts := strings.Split(str, ".")
+	if len(parts) > 2 || parts[0] == "" {
+		return 0, errors.New("Invalid amount " + str)
+	}
+
+	if len(parts) == 2 && (parts[1] == "" || len(parts[1]) > DECIMALS) {
+		return 0, errors.New("Amounts can have at most " + strconv.Itoa(DECIMALS) + " decimals")
+	}
+
+	for _, part := range parts {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, errors.New("Invalid amount " + str)
+			}
+		}
+	}
+
+	whole, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, ErrOverflow
+	}
+
+	result, err := FromCoins(whole)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(parts) == 2 {
+		digits := parts[1] + strings.Repeat("0", DECIMALS-len(parts[1]))
+		frac, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return result.Add(Amount(frac))
+	}
+
+	return result, nil
+}
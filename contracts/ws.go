@@ -5,6 +5,7 @@ import(
     "io/ioutil"
     "encoding/json"
 
+    "github.com/badlamb/dexm/params"
     "gopkg.in/olahol/melody.v1"
 )
 
@@ -51,5 +52,5 @@ func StartCDNServer() {
         s.Write(file[header.Index : header.Index + header.BlockSize])
     })
 
-    http.ListenAndServe(":8080", nil)
+    http.ListenAndServe(params.Active.CDNPort, nil)
 }
\ No newline at end of file
@@ -1,23 +1,99 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"path/filepath"
 	"regexp"
+	"time"
 
 	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
 	"github.com/badlamb/dexm/sync"
 	"github.com/badlamb/dexm/contracts"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/miner"
+	"github.com/badlamb/dexm/params"
 	"github.com/badlamb/dexm/wallet"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Makes a transaction wait until a block height, or a Unix time if the
+// value is at least wallet.LOCK_TIME_THRESHOLD
+var lockFlag = cli.Int64Flag{
+	Name:  "lock",
+	Usage: "first block height, or Unix time if above 500000000, the transaction can be mined at",
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Version = "1.0.0 pre-alpha"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "datadir",
+			Value: ".",
+			Usage: "folder where the databases are stored",
+		},
+		cli.StringFlag{
+			Name:  "network",
+			Value: "mainnet",
+			Usage: "mainnet, testnet or regtest",
+		},
+		cli.StringFlag{
+			Name:  "prefund",
+			Usage: "regtest genesis allocations as address:amount,address:amount",
+		},
+		cli.StringFlag{
+			Name:  "powschedule",
+			Usage: "regtest PoW algorithms as height:algorithm,height:algorithm",
+		},
+		cli.BoolFlag{
+			Name:  "txindex",
+			Usage: "keep transaction and address indexes, run reindex after enabling it",
+		},
+	}
+
+	// Every network gets its own databases inside the data directory
+	app.Before = func(c *cli.Context) error {
+		err := params.SetNetwork(c.GlobalString("network"))
+		if err != nil {
+			return err
+		}
+
+		if c.GlobalString("prefund") != "" {
+			allocations, err := parseAllocations(c.GlobalString("prefund"))
+			if err != nil {
+				return err
+			}
+
+			err = blockchain.SetGenesisAllocations(params.Active, allocations)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.GlobalString("powschedule") != "" {
+			schedule, err := parsePoWSchedule(c.GlobalString("powschedule"))
+			if err != nil {
+				return err
+			}
+
+			err = blockchain.SetPoWSchedule(params.Active, schedule)
+			if err != nil {
+				return err
+			}
+		}
+
+		params.TxIndex = c.GlobalBool("txindex")
+		return params.SetDataDir(c.GlobalString("datadir"))
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:    "makewallet",
@@ -50,20 +126,61 @@ func main() {
 			},
 		},
 
+		{
+			Name:    "mine",
+			Usage:   "mine [wallet]",
+			Aliases: []string{"mn"},
+			Action: func(c *cli.Context) error {
+				if c.Args().Get(0) == "" {
+					log.Fatal("Invalid wallet")
+				}
+
+				minerWallet := wallet.ImportWallet(c.Args().Get(0))
+
+				// Mining needs a full node to get transactions and share blocks
+				protocol.InitFullNode()
+				go protocol.ServeSync()
+
+				m := miner.NewMiner(protocol.GetBlockchain(), protocol.GetMempool(), minerWallet.GetWallet(), protocol.BroadcastMessage)
+				m.Start()
+
+				return nil
+			},
+		},
+
 		{
 			Name:    "maketransaction",
-			Usage:   "mkt [walletPath] [recipient] [amount]",
+			Usage:   "mkt [--lock height or time] [walletPath] [recipient] [amount] [gas]",
 			Aliases: []string{"mkt", "gt"},
+			Flags:   []cli.Flag{lockFlag},
 			Action: func(c *cli.Context) error {
 				walletPath := c.Args().Get(0)
 				recipient := c.Args().Get(1)
-				amount, err := strconv.Atoi(c.Args().Get(2))
+				err := wallet.ValidateAddress(recipient)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				amount, err := coin.Parse(c.Args().Get(2))
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				// Pay the minimum gas if it isn't specified
+				gas, err := blockchain.MIN_GAS_PRICE.Mul(int64(blockchain.EstimateTransactionGas(nil)))
+				if c.Args().Get(3) != "" {
+					gas, err = coin.Parse(c.Args().Get(3))
+				}
+
 				if err != nil {
 					log.Error(err)
 					return nil
 				}
+
 				senderWallet := wallet.ImportWallet(walletPath)
-				transaction, err := senderWallet.NewTransaction(recipient, amount, 0)
+				transaction, err := senderWallet.NewLockedTransaction(recipient, amount, gas, c.Int64("lock"))
 				if err != nil {
 					log.Error(err)
 					return nil
@@ -79,18 +196,218 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:    "getpublickey",
+			Usage:   "gpk [wallet]",
+			Aliases: []string{"gpk"},
+			Action: func(c *cli.Context) error {
+				w := wallet.ImportWallet(c.Args().Get(0))
+				log.Info("Public key is ", hex.EncodeToString(w.GetPublicKey()))
+
+				return nil
+			},
+		},
+		{
+			Name:    "makemultisig",
+			Usage:   "mms [file] [threshold] [wallets or hex public keys...]",
+			Aliases: []string{"mms"},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) < 3 {
+					log.Error("Usage: mms [file] [threshold] [wallets or hex public keys...]")
+					return nil
+				}
+
+				threshold, err := strconv.Atoi(c.Args().Get(1))
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				keys := [][]byte{}
+				for _, v := range c.Args()[2:] {
+					key, err := parsePublicKey(v)
+					if err != nil {
+						log.Error(err)
+						return nil
+					}
+
+					keys = append(keys, key)
+				}
+
+				script, err := wallet.NewMultisigScript(threshold, keys)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				err = writeJSONFile(c.Args().Get(0), script)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				log.Info("Multisig address is ", script.GetAddress())
+				return nil
+			},
+		},
+		{
+			Name:    "makemultisigtx",
+			Usage:   "mmt [--lock height or time] [tx file] [multisig file] [recipient] [amount] [gas]",
+			Aliases: []string{"mmt"},
+			Flags:   []cli.Flag{lockFlag},
+			Action: func(c *cli.Context) error {
+				var script wallet.MultisigScript
+				err := readJSONFile(c.Args().Get(1), &script)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				amount, err := coin.Parse(c.Args().Get(3))
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				gas, err := blockchain.MIN_GAS_PRICE.Mul(int64(blockchain.EstimateMultisigGas(&script)))
+				if c.Args().Get(4) != "" {
+					gas, err = coin.Parse(c.Args().Get(4))
+				}
+
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				// The multisig address has no wallet file, take the nonce
+				// from the local chain
+				bc := blockchain.OpenBlockchain()
+				_, nonce, _ := bc.GetBalance(script.GetAddress())
+
+				transaction, err := wallet.NewMultisigTransaction(&script, c.Args().Get(2), amount, gas, nonce+1, time.Now().Unix())
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				transaction.Lock = c.Int64("lock")
+				err = writeJSONFile(c.Args().Get(0), transaction)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				log.Info("Transaction needs ", script.Threshold, " signatures, sign it with signmultisig")
+				return nil
+			},
+		},
+		{
+			Name:    "signmultisig",
+			Usage:   "sms [wallet] [tx file]",
+			Aliases: []string{"sms"},
+			Action: func(c *cli.Context) error {
+				var transaction wallet.Transaction
+				err := readJSONFile(c.Args().Get(1), &transaction)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				w := wallet.ImportWallet(c.Args().Get(0))
+				err = w.SignMultisig(&transaction)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				err = writeJSONFile(c.Args().Get(1), transaction)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				log.Info("Transaction has ", len(transaction.Signatures), " signatures")
+				return nil
+			},
+		},
+		{
+			Name:    "combinemultisig",
+			Usage:   "cms [out file] [tx files...]",
+			Aliases: []string{"cms"},
+			Action: func(c *cli.Context) error {
+				transactions := []wallet.Transaction{}
+				for _, v := range c.Args().Tail() {
+					var transaction wallet.Transaction
+					err := readJSONFile(v, &transaction)
+					if err != nil {
+						log.Error(err)
+						return nil
+					}
+
+					transactions = append(transactions, transaction)
+				}
+
+				transaction, err := wallet.CombineSignatures(transactions)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				err = writeJSONFile(c.Args().Get(0), transaction)
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
+				// Only broadcast once there are enough signatures
+				valid, err := blockchain.VerifyTransactionSignature(transaction)
+				if err != nil || !valid {
+					log.Info("Transaction has ", len(transaction.Signatures), " signatures, not enough to send it")
+					return nil
+				}
+
+				log.Info("Transaction is fully signed, broadcasting it")
+				b, _ := bson.Marshal(transaction)
+
+				protocol.InitPartialNode()
+				protocol.BroadcastMessage(1, b)
+
+				return nil
+			},
+		},
 		{
 			Name:    "getbalance",
 			Usage:   "gb [wallet]",
 			Aliases: []string{"gb", "fb"},
 			Action: func(c *cli.Context) error {
+				err := wallet.ValidateAddress(c.Args().Get(0))
+				if err != nil {
+					log.Error(err)
+					return nil
+				}
+
 				bc := blockchain.OpenBlockchain()
 				bal, _, _ := bc.GetBalance(c.Args().Get(0))
-				log.Info("Balance for given wallet is ", bal)
+				log.Info("Balance for given wallet is ", bal, " Dexm")
 
 				return nil
 			},
 		},
+		{
+			Name:    "estimatefee",
+			Usage:   "ef",
+			Aliases: []string{"ef"},
+			Action: func(c *cli.Context) error {
+				// Without a running node the mempool is empty, so only
+				// recent blocks are used
+				bc := blockchain.OpenBlockchain()
+				estimate := mempool.NewMempool(bc).EstimateFee()
+
+				log.Info("Suggested gas price is ", estimate.GasPrice, " Dexm")
+				log.Info("A transfer uses up to ", estimate.TransferGas, " gas, pay ", estimate.TransferFee, " Dexm")
+				return nil
+			},
+		},
 		{
 			Name:    "fixwallet",
 			Usage:   "fw [walletfile]",
@@ -110,6 +427,173 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:    "rollback",
+			Usage:   "rollback [blocks]",
+			Action: func(c *cli.Context) error {
+				blocks, err := strconv.Atoi(c.Args().Get(0))
+				if err != nil || blocks <= 0 {
+					log.Fatal("Invalid number of blocks")
+				}
+
+				bc := blockchain.OpenBlockchain()
+				err = bc.Rollback(int64(blocks))
+				if err != nil {
+					log.Error(err)
+				}
+
+				log.Info("Chain is now ", bc.GetLen(), " blocks long")
+				return nil
+			},
+		},
+		{
+			Name:    "generate",
+			Usage:   "generate [blocks] [address]",
+			Action: func(c *cli.Context) error {
+				blocks, err := strconv.Atoi(c.Args().Get(0))
+				if err != nil || blocks <= 0 {
+					log.Fatal("Invalid number of blocks")
+				}
+
+				// Without an address rewards go to a throwaway wallet
+				address := c.Args().Get(1)
+				if address == "" {
+					address = wallet.GenerateWallet().GetWallet()
+				}
+
+				err = wallet.ValidateAddress(address)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				protocol.InitFullNode()
+
+				m := miner.NewMiner(protocol.GetBlockchain(), protocol.GetMempool(), address, protocol.BroadcastMessage)
+				hashes, err := m.Generate(blocks)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				for _, v := range hashes {
+					log.Info("Generated block ", hex.EncodeToString([]byte(v)))
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:    "reindex",
+			Usage:   "reindex",
+			Action: func(c *cli.Context) error {
+				params.TxIndex = true
+
+				bc := blockchain.OpenBlockchain()
+				err := bc.Reindex()
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				log.Info("Indexed ", bc.GetLen(), " blocks")
+				return nil
+			},
+		},
+		{
+			Name:    "gethistory",
+			Usage:   "gh [wallet]",
+			Aliases: []string{"gh"},
+			Action: func(c *cli.Context) error {
+				err := wallet.ValidateAddress(c.Args().Get(0))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				// Needs the index built by reindex
+				params.TxIndex = true
+
+				bc := blockchain.OpenBlockchain()
+				history, err := bc.GetAddressHistory(c.Args().Get(0), 100)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				for _, v := range history {
+					log.Info("Block ", v.Height, " ", blockchain.RoleNames[v.Role], " ", hex.EncodeToString(v.Id))
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:    "exportchain",
+			Usage:   "exportchain [file]",
+			Action: func(c *cli.Context) error {
+				if c.Args().Get(0) == "" {
+					log.Fatal("Invalid filename")
+				}
+
+				file, err := os.Create(c.Args().Get(0))
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer file.Close()
+
+				bc := blockchain.OpenBlockchain()
+				exported, err := bc.ExportChain(file)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				log.Info("Exported ", exported, " blocks")
+				return nil
+			},
+		},
+		{
+			Name:    "importchain",
+			Usage:   "importchain [file]",
+			Action: func(c *cli.Context) error {
+				file, err := os.Open(c.Args().Get(0))
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer file.Close()
+
+				// Creates the chain if this is a new node
+				protocol.InitPartialNode()
+
+				bc := protocol.GetBlockchain()
+				imported, err := bc.ImportChain(file)
+				log.Info("Imported ", imported, " blocks, chain is now ", bc.GetLen(), " blocks long")
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:    "verifychain",
+			Usage:   "verifychain",
+			Action: func(c *cli.Context) error {
+				bc := blockchain.OpenBlockchain()
+				report, err := bc.VerifyChain()
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				log.Info("Checked ", report.Blocks, " blocks and ", report.Accounts, " accounts")
+
+				if report.FirstBadBlock != -1 {
+					log.Fatal("Block ", report.FirstBadBlock, " is invalid: ", report.BlockError)
+				}
+
+				if report.DivergentAccount != "" {
+					log.Fatal("Wallet ", report.DivergentAccount, " diverges: ", report.AccountError)
+				}
+
+				log.Info("Chain and balances are consistent")
+				return nil
+			},
+		},
 		{
 			Name:    "makecdn",
 			Usage:   "mc [static folder] [wallet]",
@@ -169,3 +653,77 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// Parses a list of allocations in the address:amount,address:amount format
+func parseAllocations(list string) ([]params.Allocation, error) {
+	allocations := []params.Allocation{}
+
+	for _, v := range strings.Split(list, ",") {
+		parts := strings.Split(v, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid allocation " + v)
+		}
+
+		err := wallet.ValidateAddress(parts[0])
+		if err != nil {
+			return nil, errors.New("Invalid address in allocation " + v + ": " + err.Error())
+		}
+
+		amount, err := coin.Parse(parts[1])
+		if err != nil || amount <= 0 {
+			return nil, errors.New("Invalid amount in allocation " + v)
+		}
+
+		allocations = append(allocations, params.Allocation{Address: parts[0], Amount: amount})
+	}
+
+	return allocations, nil
+}
+
+// Parses a PoW schedule in the height:algorithm,height:algorithm format
+func parsePoWSchedule(list string) ([]params.PoWActivation, error) {
+	schedule := []params.PoWActivation{}
+
+	for _, v := range strings.Split(list, ",") {
+		parts := strings.Split(v, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid PoW activation " + v)
+		}
+
+		height, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || height < 0 {
+			return nil, errors.New("Invalid height in PoW activation " + v)
+		}
+
+		schedule = append(schedule, params.PoWActivation{Height: height, Algorithm: parts[1]})
+	}
+
+	return schedule, nil
+}
+
+// Reads a public key from a wallet file or from its hex encoding
+func parsePublicKey(arg string) ([]byte, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return wallet.ImportWallet(arg).GetPublicKey(), nil
+	}
+
+	return hex.DecodeString(arg)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
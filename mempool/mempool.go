@@ -0,0 +1,365 @@
+package mempool
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum amount of transactions kept in memory
+	MAX_POOL_SIZE = 10000
+
+	// Transactions older than this (in seconds) are dropped
+	TRANSACTION_TTL = 3 * 60 * 60
+
+	// How far in the future a transaction timestamp can be
+	MAX_FUTURE_DRIFT = 10 * 60
+
+	DELAY_BETWEEN_CLEANUPS = 30 * time.Second
+
+	// How many blocks are looked at to estimate fees
+	FEE_ESTIMATE_BLOCKS = 10
+)
+
+type poolEntry struct {
+	transaction wallet.Transaction
+	sender      string
+	gasPrice    coin.Amount
+}
+
+// Suggested fees for a transaction to be mined soon
+type FeeEstimate struct {
+	GasPrice    coin.Amount `bson:"p" json:"gasPrice"`
+	TransferGas int         `bson:"g" json:"transferGas"`
+	TransferFee coin.Amount `bson:"f" json:"transferFee"`
+}
+
+// Mempool holds verified transactions that haven't been included in a block
+// yet. Transactions are indexed by sender and SenderNonce, this way a sender
+// can replace a pending transaction by resending the same nonce with more gas.
+// The nonces pending for a sender always follow the last one used on chain
+// without gaps.
+type Mempool struct {
+	mu      sync.Mutex
+	bc      *blockchain.BlockChain
+	senders map[string]map[int]*poolEntry
+	size    int
+}
+
+func NewMempool(bc *blockchain.BlockChain) *Mempool {
+	return &Mempool{
+		bc:      bc,
+		senders: make(map[string]map[int]*poolEntry),
+	}
+}
+
+// Returns how many transactions are waiting in the pool
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.size
+}
+
+// Verifies a transaction and stores it in the pool. If a transaction with
+// the same sender and nonce is already pending it gets replaced only if the
+// new one pays more gas.
+func (m *Mempool) AddTransaction(t wallet.Transaction) error {
+	err := blockchain.VerifyTransaction(t)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if isExpired(t, now) {
+		return errors.New("Transaction is expired")
+	}
+
+	// Transactions only wait TRANSACTION_TTL in the pool, so locked ones
+	// have to be sent again once they can be mined
+	err = blockchain.CheckLock(t, m.bc.GetLen(), now)
+	if err != nil {
+		return err
+	}
+
+	if t.Timestamp > now+MAX_FUTURE_DRIFT {
+		return errors.New("Transaction timestamp is too far in the future")
+	}
+
+	sender := wallet.BytesToAddress(t.Sender)
+	balance, nonce, _ := m.bc.GetBalance(sender)
+
+	if t.SenderNonce <= nonce {
+		return blockchain.ErrNonceUsed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := m.senders[sender]
+
+	// Check if this is a replacement
+	old, replacing := pending[t.SenderNonce]
+	if replacing && old.transaction.Gas >= t.Gas {
+		return errors.New("A transaction with this nonce is already pending")
+	}
+
+	// Otherwise it has to follow the last pending or confirmed nonce
+	if !replacing {
+		_, hasPrevious := pending[t.SenderNonce-1]
+		if t.SenderNonce != nonce+1 && !hasPrevious {
+			return blockchain.ErrNonceGap
+		}
+	}
+
+	// All pending transactions from the sender have to be payable at once
+	spent, err := coin.Sum(t.Amount, t.Gas)
+	for k, v := range pending {
+		if err == nil && k != t.SenderNonce {
+			spent, err = coin.Sum(spent, v.transaction.Amount, v.transaction.Gas)
+		}
+	}
+
+	if err != nil || spent > balance {
+		return errors.New("Balance is too low for all pending transactions")
+	}
+
+	if !replacing && m.size >= MAX_POOL_SIZE {
+		// Make room by dropping the cheapest transaction of another sender
+		cheapest := m.cheapest(sender)
+		if cheapest == nil || cheapest.gasPrice >= blockchain.GetGasPrice(t) {
+			return errors.New("Mempool is full")
+		}
+
+		m.removeFrom(cheapest.sender, cheapest.transaction.SenderNonce)
+	}
+
+	if pending == nil {
+		pending = make(map[int]*poolEntry)
+		m.senders[sender] = pending
+	}
+
+	if !replacing {
+		m.size++
+	}
+
+	pending[t.SenderNonce] = &poolEntry{
+		transaction: t,
+		sender:      sender,
+		gasPrice:    blockchain.GetGasPrice(t),
+	}
+
+	return nil
+}
+
+// Removes transactions that have been included in a block
+func (m *Mempool) RemoveTransactions(transactions []wallet.Transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range transactions {
+		m.remove(wallet.BytesToAddress(v.Sender), v.SenderNonce)
+	}
+}
+
+// Evicts expired transactions and transactions that can't be included
+// anymore because their nonce was used or the sender's balance dropped.
+// Transactions after a removed one are dropped too, as they can't be
+// included until the gap is filled.
+func (m *Mempool) Cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	for sender, pending := range m.senders {
+		balance, nonce, _ := m.bc.GetBalance(sender)
+
+		var spent coin.Amount
+		next := nonce + 1
+		for _, k := range sortedNonces(pending) {
+			if k <= nonce {
+				m.remove(sender, k)
+				continue
+			}
+
+			t := pending[k].transaction
+
+			var err error
+			spent, err = coin.Sum(spent, t.Amount, t.Gas)
+
+			if err != nil || k != next || isExpired(t, now) || spent > balance {
+				m.removeFrom(sender, k)
+				break
+			}
+
+			next++
+		}
+	}
+}
+
+// Periodically cleans up the mempool
+func (m *Mempool) AutoCleanup() {
+	for {
+		m.Cleanup()
+		log.Debug("Transactions in mempool: ", m.Len())
+
+		time.Sleep(DELAY_BETWEEN_CLEANUPS)
+	}
+}
+
+// Returns up to max transactions to put in a new block. Transactions with
+// a higher gas price come first, but transactions from the same sender are
+// always returned in nonce order.
+func (m *Mempool) SelectTransactions(max int) []wallet.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := []wallet.Transaction{}
+	for _, v := range m.ordered(max) {
+		result = append(result, v.transaction)
+	}
+
+	return result
+}
+
+// Suggests a gas price based on recent blocks. If the pending transactions
+// don't fit in the next block the price has to beat the ones left out.
+func (m *Mempool) EstimateFee() FeeEstimate {
+	price := m.bc.GetRecentGasPrice(FEE_ESTIMATE_BLOCKS)
+
+	m.mu.Lock()
+	gas := 0
+	for _, v := range m.ordered(m.size) {
+		gas += blockchain.GetTransactionGas(v.transaction)
+		if gas > blockchain.MAX_BLOCK_GAS {
+			if v.gasPrice >= price {
+				price, _ = v.gasPrice.Add(1)
+			}
+
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if price < blockchain.MIN_GAS_PRICE {
+		price = blockchain.MIN_GAS_PRICE
+	}
+
+	transferGas := blockchain.EstimateTransactionGas(nil)
+	fee, err := price.Mul(int64(transferGas))
+	if err != nil {
+		fee = coin.MAX_AMOUNT
+	}
+
+	return FeeEstimate{
+		GasPrice:    price,
+		TransferGas: transferGas,
+		TransferFee: fee,
+	}
+}
+
+// Returns up to max entries in the order they should be mined. Must be
+// called with the lock held.
+func (m *Mempool) ordered(max int) []*poolEntry {
+	// Build a queue ordered by nonce for every sender
+	var queues [][]*poolEntry
+	for _, pending := range m.senders {
+		queue := []*poolEntry{}
+		for _, k := range sortedNonces(pending) {
+			queue = append(queue, pending[k])
+		}
+
+		queues = append(queues, queue)
+	}
+
+	result := []*poolEntry{}
+	for len(result) < max && len(queues) > 0 {
+		// Pick the sender whose next transaction has the best gas price
+		best := 0
+		for i := range queues {
+			if queues[i][0].gasPrice > queues[best][0].gasPrice {
+				best = i
+			}
+		}
+
+		result = append(result, queues[best][0])
+		queues[best] = queues[best][1:]
+
+		if len(queues[best]) == 0 {
+			queues = append(queues[:best], queues[best+1:]...)
+		}
+	}
+
+	return result
+}
+
+// Returns the pending transaction with the lowest gas price, ignoring the
+// ones of a given sender. Must be called with the lock held.
+func (m *Mempool) cheapest(skip string) *poolEntry {
+	var result *poolEntry
+
+	for sender, pending := range m.senders {
+		if sender == skip {
+			continue
+		}
+
+		for _, v := range pending {
+			if result == nil || v.gasPrice < result.gasPrice {
+				result = v
+			}
+		}
+	}
+
+	return result
+}
+
+// Deletes a transaction from the pool. Must be called with the lock held.
+func (m *Mempool) remove(sender string, nonce int) {
+	pending, ok := m.senders[sender]
+	if !ok {
+		return
+	}
+
+	if _, ok := pending[nonce]; !ok {
+		return
+	}
+
+	delete(pending, nonce)
+	m.size--
+
+	if len(pending) == 0 {
+		delete(m.senders, sender)
+	}
+}
+
+// Deletes a transaction and all later ones from the same sender. Must be
+// called with the lock held.
+func (m *Mempool) removeFrom(sender string, nonce int) {
+	for _, k := range sortedNonces(m.senders[sender]) {
+		if k >= nonce {
+			m.remove(sender, k)
+		}
+	}
+}
+
+func sortedNonces(pending map[int]*poolEntry) []int {
+	nonces := []int{}
+	for k := range pending {
+		nonces = append(nonces, k)
+	}
+
+	sort.Ints(nonces)
+	return nonces
+}
+
+func isExpired(t wallet.Transaction, now int64) bool {
+	return t.Timestamp+TRANSACTION_TTL < now
+}
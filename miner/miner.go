@@ -0,0 +1,283 @@
+package miner
+
+import (
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Maximum amount of transactions put in a mined block
+	MAX_BLOCK_TRANSACTIONS = 1000
+
+	// After this time a new candidate is made, this way new transactions
+	// and a fresh timestamp end up in the block.
+	CANDIDATE_LIFETIME = 30 * time.Second
+
+	// How often workers check if the chain has a new tip
+	TIP_CHECK_INTERVAL = 1 * time.Second
+
+	HASHRATE_REPORT_INTERVAL = 10 * time.Second
+
+	// Space left in a block for everything that isn't a transaction
+	BLOCK_HEADER_SPACE = 4096
+)
+
+type Miner struct {
+	bc      *blockchain.BlockChain
+	pool    *mempool.Mempool
+	address string
+
+	// Called with message Id and data to share found blocks
+	broadcast func(int, []byte)
+
+	hashes  uint64
+	threads int
+}
+
+// Creates a miner that pays rewards to address and uses all cores
+func NewMiner(bc *blockchain.BlockChain, pool *mempool.Mempool, address string, broadcast func(int, []byte)) *Miner {
+	return &Miner{
+		bc:        bc,
+		pool:      pool,
+		address:   address,
+		broadcast: broadcast,
+		threads:   runtime.NumCPU(),
+	}
+}
+
+// Mines blocks forever
+func (m *Miner) Start() {
+	log.Info("Mining with ", m.threads, " threads to ", m.address)
+	go m.reportHashrate()
+
+	for {
+		candidate, err := m.newCandidate()
+		if err != nil {
+			log.Error(err)
+			time.Sleep(TIP_CHECK_INTERVAL)
+			continue
+		}
+
+		solution := m.search(candidate)
+		if solution == nil {
+			// The candidate got stale, make a new one
+			continue
+		}
+
+		err = m.submit(solution)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Mines n blocks right away and returns their hashes. Only works on regtest,
+// where the difficulty is low enough for this to be instant.
+func (m *Miner) Generate(n int) ([]string, error) {
+	if !params.Active.IsRegtest {
+		return nil, errors.New("Blocks can only be generated on regtest")
+	}
+
+	hashes := []string{}
+	for len(hashes) < n {
+		candidate, err := m.newCandidate()
+		if err != nil {
+			return hashes, err
+		}
+
+		solution := m.search(candidate)
+		if solution == nil {
+			continue
+		}
+
+		err = m.submit(solution)
+		if err != nil {
+			return hashes, err
+		}
+
+		hashes = append(hashes, solution.MinedBlock.Hash)
+	}
+
+	return hashes, nil
+}
+
+// Builds a block on top of the current tip with the best paying transactions
+func (m *Miner) newCandidate() (*blockchain.Block, error) {
+	// Skip transactions that became invalid while waiting in the mempool
+	state := m.bc.NewBalanceState()
+	transactions := []wallet.Transaction{}
+	size := 0
+	gas := 0
+
+	for _, v := range m.pool.SelectTransactions(MAX_BLOCK_TRANSACTIONS) {
+		encoded, err := bson.Marshal(v)
+		if err != nil {
+			continue
+		}
+
+		// Smaller transactions after this one might still fit
+		if size+len(encoded) > blockchain.MAX_BLOCK_SIZE-BLOCK_HEADER_SPACE {
+			continue
+		}
+
+		used := blockchain.GetTransactionGas(v)
+		if gas+used > blockchain.MAX_BLOCK_GAS {
+			continue
+		}
+
+		_, err = state.ApplyTransaction(v)
+		if err != nil {
+			log.Debug("Skipping transaction: ", err)
+			continue
+		}
+
+		transactions = append(transactions, v)
+		size += len(encoded)
+		gas += used
+	}
+
+	transactionList, err := blockchain.EncodeTransactions(transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	candidate, err := m.bc.NewBlock(transactionList, nil, m.address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't start searching if the block can't be hashed
+	_, err = blockchain.GetPoWAlgorithm(candidate.Index)
+	return candidate, err
+}
+
+// Searches for a nonce on all cores. Returns nil if the tip changed or the
+// candidate expired before a solution was found.
+func (m *Miner) search(candidate *blockchain.Block) *blockchain.PoWBlock {
+	target := blockchain.GetTarget(candidate.GetHeaderDifficulty())
+	encoded := candidate.GetBytes()
+
+	// The algorithm can change at any height, newCandidate checked it exists
+	algorithm, err := blockchain.GetPoWAlgorithm(candidate.Index)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	stop := make(chan struct{})
+	solutions := make(chan []byte, m.threads)
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.threads; i++ {
+		wg.Add(1)
+
+		// Every worker tries a different set of nonces
+		go func(start uint64) {
+			defer wg.Done()
+
+			nonce := make([]byte, 8)
+			for n, tries := start, 0; ; n, tries = n+uint64(m.threads), tries+1 {
+				// Don't check the channel on every hash
+				if tries%1024 == 0 {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+				}
+
+				binary.BigEndian.PutUint64(nonce, n)
+
+				hash, err := algorithm.Sum(nonce, encoded)
+				if err != nil {
+					log.Error(err)
+					return
+				}
+
+				atomic.AddUint64(&m.hashes, 1)
+
+				if hash.Cmp(target) <= 0 {
+					solutions <- append([]byte{}, nonce...)
+					return
+				}
+			}
+		}(uint64(i))
+	}
+
+	var result *blockchain.PoWBlock
+
+	expire := time.After(CANDIDATE_LIFETIME)
+	tipCheck := time.NewTicker(TIP_CHECK_INTERVAL)
+	defer tipCheck.Stop()
+
+search:
+	for {
+		select {
+		case nonce := <-solutions:
+			result = &blockchain.PoWBlock{
+				Nonce:      nonce,
+				MinedBlock: candidate,
+			}
+			break search
+		case <-expire:
+			break search
+		case <-tipCheck.C:
+			// Someone else found a block
+			if m.bc.GetLen() != candidate.Index {
+				break search
+			}
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	return result
+}
+
+// Stores a solved block and shares it with peers
+func (m *Miner) submit(solution *blockchain.PoWBlock) error {
+	err := m.bc.AddBlock(solution)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Mined block ", solution.MinedBlock.Index)
+
+	transactions, err := blockchain.DecodeTransactions(solution.MinedBlock.TransactionList)
+	if err != nil {
+		return err
+	}
+
+	m.pool.RemoveTransactions(transactions)
+
+	encoded, err := bson.Marshal(solution)
+	if err != nil {
+		return errors.New("Unable to encode mined block: " + err.Error())
+	}
+
+	m.broadcast(2, encoded)
+
+	return nil
+}
+
+// Periodically logs how many hashes per second are being computed
+func (m *Miner) reportHashrate() {
+	for {
+		time.Sleep(HASHRATE_REPORT_INTERVAL)
+
+		hashes := atomic.SwapUint64(&m.hashes, 0)
+		log.Info("Hashrate: ", float64(hashes)/HASHRATE_REPORT_INTERVAL.Seconds(), " H/s")
+	}
+}
@@ -0,0 +1,154 @@
+package params
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/badlamb/dexm/coin"
+)
+
+// Coins given to a wallet by the genesis block
+type Allocation struct {
+	Address string
+	Amount  coin.Amount
+}
+
+// Names of the proof of work algorithms
+const (
+	POW_LYRA2REV2 = "lyra2rev2"
+	POW_BLAKE2B   = "blake2b"
+)
+
+// Proof of work algorithm used from a block height on
+type PoWActivation struct {
+	Height    int64
+	Algorithm string
+}
+
+// Network holds everything that differs between Dexm networks, this way
+// many nodes on different networks can run on the same machine.
+type Network struct {
+	Name string
+
+	// Port used by the sync server
+	Port string
+
+	// Port used by the CDN server
+	CDNPort string
+
+	// Every address on the network starts with this
+	AddressPrefix string
+
+	// Sent with every message, peers on other networks are ignored
+	Magic [4]byte
+
+	// The genesis block is built from these, GenesisHash is the hex
+	// encoded hash it must have.
+	GenesisDifficulty int64
+	GenesisTimestamp  int64
+	GenesisMessage    string
+	GenesisMiner      string
+	Allocations       []Allocation
+	GenesisHash       string
+
+	// Proof of work algorithms sorted by activation height, the first one
+	// has to start at height 0. Each is used until the next one activates.
+	PoWSchedule []PoWActivation
+
+	// Folder inside the data directory used for the databases
+	DataSubdir string
+
+	// Regtest networks keep the genesis difficulty, can generate blocks on
+	// demand and can change the genesis allocations and the PoW schedule.
+	IsRegtest bool
+}
+
+var (
+	Mainnet = &Network{
+		Name:              "mainnet",
+		Port:              ":3141",
+		CDNPort:           ":8080",
+		AddressPrefix:     "Dexm",
+		Magic:             [4]byte{0xde, 0x4d, 0x01, 0x00},
+		GenesisDifficulty: 20000000000000,
+		GenesisTimestamp:  1519862400,
+		GenesisMessage:    "Donald Trump Jr was wrong to meet Russian, says FBI chief Christopher Wray",
+		GenesisMiner:      "DexmRGumsYPEB78aD6utysna9Yvs3Fu9614001e",
+		Allocations: []Allocation{
+			{Address: "DexmRGumsYPEB78aD6utysna9Yvs3Fu9614001e", Amount: 50 * coin.COIN},
+		},
+		GenesisHash: "ff90ed6ef4bc11dfce708a97e81e5bae3e1f3105ddd16042b4a45c17c4c9c246",
+		PoWSchedule: []PoWActivation{
+			{Height: 0, Algorithm: POW_LYRA2REV2},
+		},
+		DataSubdir: "",
+	}
+
+	Testnet = &Network{
+		Name:              "testnet",
+		Port:              ":13141",
+		CDNPort:           ":18080",
+		AddressPrefix:     "Dext",
+		Magic:             [4]byte{0xde, 0x4d, 0x02, 0x00},
+		GenesisDifficulty: 2000000,
+		GenesisTimestamp:  1519862400,
+		GenesisMessage:    "Dexm testnet",
+		GenesisHash:       "bae06c50791a3cdb56fad65d1bc127cd7c020786d965fc6261d551c6d73216c9",
+		PoWSchedule: []PoWActivation{
+			{Height: 0, Algorithm: POW_LYRA2REV2},
+		},
+		DataSubdir: "testnet",
+	}
+
+	Regtest = &Network{
+		Name:              "regtest",
+		Port:              ":23141",
+		CDNPort:           ":28080",
+		AddressPrefix:     "Dexr",
+		Magic:             [4]byte{0xde, 0x4d, 0x03, 0x00},
+		GenesisDifficulty: 1,
+		GenesisTimestamp:  1519862400,
+		GenesisMessage:    "Dexm regtest",
+		GenesisHash:       "d796e34697150da1a4bf0416f774b79cfa50ab0fa8618f61795e36a6667afab5",
+		PoWSchedule: []PoWActivation{
+			{Height: 0, Algorithm: POW_LYRA2REV2},
+		},
+		DataSubdir: "regtest",
+		IsRegtest:  true,
+	}
+
+	networks = []*Network{Mainnet, Testnet, Regtest}
+)
+
+// Network, data directory and options used by this process
+var (
+	Active  = Mainnet
+	DataDir = "."
+
+	// Keep the transaction and address indexes in index.db
+	TxIndex = false
+)
+
+// Selects the active network by name
+func SetNetwork(name string) error {
+	for _, v := range networks {
+		if v.Name == name {
+			Active = v
+			return nil
+		}
+	}
+
+	return errors.New("Unknown network " + name)
+}
+
+// Sets the data directory and creates the folder of the active network
+func SetDataDir(dir string) error {
+	DataDir = dir
+	return os.MkdirAll(GetPath(""), 0755)
+}
+
+// Returns the path of a file in the data directory of the active network
+func GetPath(name string) string {
+	return filepath.Join(DataDir, Active.DataSubdir, name)
+}
@@ -0,0 +1,504 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Blocks returned by /explorer/latest when ?n isn't set
+	DEFAULT_LATEST_BLOCKS = 10
+	MAX_LATEST_BLOCKS     = 100
+
+	// Most recent transactions returned in the history of an address
+	MAX_ADDRESS_HISTORY = 100
+)
+
+// A transaction as shown by the explorer, hashes are hex encoded and
+// amounts are in base units
+type TransactionView struct {
+	Id          string      `bson:"id" json:"id"`
+	Sender      string      `bson:"s" json:"sender"`
+	Recipient   string      `bson:"r" json:"recipient"`
+	Amount      coin.Amount `bson:"a" json:"amount"`
+	Gas         coin.Amount `bson:"g" json:"gas"`
+	SenderNonce int         `bson:"n" json:"nonce"`
+	Timestamp   int64       `bson:"t" json:"timestamp"`
+	Lock        int64       `bson:"l,omitempty" json:"lock,omitempty"`
+
+	// BlockIndex is -1 for transactions still in the mempool
+	BlockIndex int64  `bson:"bi" json:"blockIndex"`
+	BlockHash  string `bson:"bh" json:"blockHash"`
+
+	// In the history of an address, how the address took part in it
+	Role string `bson:"ro,omitempty" json:"role,omitempty"`
+}
+
+// A block as shown by the explorer, hashes are hex encoded
+type BlockView struct {
+	Index             int64             `bson:"i" json:"index"`
+	Hash              string            `bson:"h" json:"hash"`
+	PreviousBlockHash string            `bson:"p" json:"previousHash"`
+	Timestamp         int64             `bson:"t" json:"timestamp"`
+	Miner             string            `bson:"m" json:"miner"`
+	Difficulty        string            `bson:"d" json:"difficulty"`
+	MerkleRoot        string            `bson:"r" json:"merkleRoot"`
+	StateRoot         string            `bson:"sr" json:"stateRoot"`
+	Nonce             string            `bson:"n" json:"nonce"`
+	PoWAlgorithm      string            `bson:"pa" json:"powAlgorithm"`
+	Size              int               `bson:"sz" json:"size"`
+	Transactions      []TransactionView `bson:"tx" json:"transactions"`
+}
+
+// Balance, nonce, burn and latest transactions of an address
+type AddressView struct {
+	Wallet     string            `bson:"w" json:"wallet"`
+	Balance    coin.Amount       `bson:"b" json:"balance"`
+	Nonce      int               `bson:"n" json:"nonce"`
+	Burn       coin.Amount       `bson:"bu" json:"burn"`
+	BurnWeight coin.Amount       `bson:"bw" json:"burnWeight"`
+	History    []TransactionView `bson:"h" json:"history"`
+}
+
+// General information about the chain
+type ChainStats struct {
+	Network          string      `bson:"net" json:"network"`
+	Height           int64       `bson:"h" json:"height"`
+	TipHash          string      `bson:"t" json:"tipHash"`
+	Difficulty       string      `bson:"d" json:"difficulty"`
+	Work             string      `bson:"w" json:"work"`
+	AverageBlockTime int64       `bson:"bt" json:"averageBlockTime"`
+	MempoolSize      int         `bson:"m" json:"mempoolSize"`
+	GasPrice         coin.Amount `bson:"g" json:"gasPrice"`
+}
+
+// Writes value as bson, or as json if ?json=true
+func writeResponse(w http.ResponseWriter, r *http.Request, value interface{}) {
+	var data []byte
+	var err error
+
+	if r.URL.Query().Get("json") != "true" {
+		data, err = bson.Marshal(value)
+	} else {
+		data, err = json.Marshal(value)
+	}
+
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
+
+func newTransactionView(t wallet.Transaction, block *blockchain.Block) TransactionView {
+	view := TransactionView{
+		Id:          hex.EncodeToString(t.GetHash()),
+		Sender:      wallet.BytesToAddress(t.Sender),
+		Recipient:   t.Recipient,
+		Amount:      t.Amount,
+		Gas:         t.Gas,
+		SenderNonce: t.SenderNonce,
+		Timestamp:   t.Timestamp,
+		Lock:        t.Lock,
+		BlockIndex:  -1,
+	}
+
+	if block != nil {
+		view.BlockIndex = block.Index
+		view.BlockHash = hex.EncodeToString([]byte(block.Hash))
+	}
+
+	return view
+}
+
+func newBlockView(mined *blockchain.PoWBlock) (*BlockView, error) {
+	b := mined.MinedBlock
+
+	encoded, err := bson.Marshal(mined)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &BlockView{
+		Index:             b.Index,
+		Hash:              hex.EncodeToString([]byte(b.Hash)),
+		PreviousBlockHash: hex.EncodeToString([]byte(b.PreviousBlockHash)),
+		Timestamp:         b.Timestamp,
+		Miner:             b.Miner,
+		Difficulty:        b.GetHeaderDifficulty().String(),
+		MerkleRoot:        hex.EncodeToString(b.MerkleRoot),
+		StateRoot:         hex.EncodeToString(b.StateRoot),
+		Nonce:             hex.EncodeToString(mined.Nonce),
+		Size:              len(encoded),
+		Transactions:      []TransactionView{},
+	}
+
+	algorithm, err := blockchain.GetPoWAlgorithm(b.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	view.PoWAlgorithm = algorithm.Name()
+
+	// The genesis has a message instead of transactions
+	if b.Index == 0 {
+		return view, nil
+	}
+
+	transactions, err := blockchain.DecodeTransactions(b.TransactionList)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range transactions {
+		view.Transactions = append(view.Transactions, newTransactionView(v, b))
+	}
+
+	return view, nil
+}
+
+// Calls f with every main chain block from the tip to the first one,
+// stops when f returns false.
+func walkChain(f func(b *blockchain.Block, transactions []wallet.Transaction) bool) error {
+	for i := bc.GetLen() - 1; i > 0; i-- {
+		b, err := bc.GetBlock(i)
+		if err != nil {
+			return err
+		}
+
+		transactions, err := blockchain.DecodeTransactions(b.TransactionList)
+		if err != nil {
+			return err
+		}
+
+		if !f(b, transactions) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// The reward of a block in the history of its miner
+func newMinedView(b *blockchain.Block) TransactionView {
+	return TransactionView{
+		Recipient:  b.Miner,
+		Timestamp:  b.Timestamp,
+		BlockIndex: b.Index,
+		BlockHash:  hex.EncodeToString([]byte(b.Hash)),
+		Role:       blockchain.RoleNames[blockchain.ROLE_MINED],
+	}
+}
+
+// Finds a transaction in the mempool or in the main chain
+func findTransaction(txid []byte) (*TransactionView, error) {
+	for _, v := range pool.SelectTransactions(pool.Len()) {
+		if string(v.GetHash()) == string(txid) {
+			view := newTransactionView(v, nil)
+			return &view, nil
+		}
+	}
+
+	if bc.Index != nil {
+		t, b, err := bc.GetTransaction(txid)
+		if err != nil {
+			return nil, errors.New("Transaction not found")
+		}
+
+		view := newTransactionView(*t, b)
+		return &view, nil
+	}
+
+	// Without indexes every block has to be decoded
+
+	var result *TransactionView
+	err := walkChain(func(b *blockchain.Block, transactions []wallet.Transaction) bool {
+		for _, v := range transactions {
+			if string(v.GetHash()) == string(txid) {
+				view := newTransactionView(v, b)
+				result = &view
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, errors.New("Transaction not found")
+	}
+
+	return result, nil
+}
+
+// Returns the latest transactions sent, received, mined or burned by an
+// address
+func getAddressHistory(address string) ([]TransactionView, error) {
+	if bc.Index != nil {
+		return getIndexedHistory(address)
+	}
+
+	history := []TransactionView{}
+
+	// Without indexes every block has to be decoded
+	err := walkChain(func(b *blockchain.Block, transactions []wallet.Transaction) bool {
+		if b.Miner == address {
+			history = append(history, newMinedView(b))
+		}
+
+		// Newest transactions first
+		for i := len(transactions) - 1; i >= 0; i-- {
+			v := transactions[i]
+			role := byte(0)
+
+			if wallet.BytesToAddress(v.Sender) == address {
+				role = blockchain.ROLE_SENT
+				if v.Recipient == wallet.BurnAddress() {
+					role = blockchain.ROLE_BURNED
+				}
+			} else if v.Recipient == address {
+				role = blockchain.ROLE_RECEIVED
+			}
+
+			if role != 0 {
+				view := newTransactionView(v, b)
+				view.Role = blockchain.RoleNames[role]
+				history = append(history, view)
+			}
+		}
+
+		return len(history) < MAX_ADDRESS_HISTORY
+	})
+
+	if len(history) > MAX_ADDRESS_HISTORY {
+		history = history[:MAX_ADDRESS_HISTORY]
+	}
+
+	return history, err
+}
+
+// Builds the history of an address from the address index
+func getIndexedHistory(address string) ([]TransactionView, error) {
+	entries, err := bc.GetAddressHistory(address, MAX_ADDRESS_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []TransactionView{}
+	for _, v := range entries {
+		if v.Role == blockchain.ROLE_MINED {
+			b, err := bc.GetBlockByHash(string(v.Id))
+			if err != nil {
+				return nil, err
+			}
+
+			history = append(history, newMinedView(b))
+			continue
+		}
+
+		t, b, err := bc.GetTransaction(v.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		view := newTransactionView(*t, b)
+		view.Role = blockchain.RoleNames[v.Role]
+		history = append(history, view)
+	}
+
+	return history, nil
+}
+
+// explorerBlock returns the block at ?height or with hex hash ?hash
+func explorerBlock(w http.ResponseWriter, r *http.Request) {
+	var mined *blockchain.PoWBlock
+	var err error
+
+	if r.FormValue("hash") != "" {
+		hash, decodeErr := hex.DecodeString(r.FormValue("hash"))
+		if decodeErr != nil {
+			http.Error(w, "Invalid hash", http.StatusBadRequest)
+			return
+		}
+
+		mined, err = bc.GetPoWBlockByHash(string(hash))
+	} else {
+		height, parseErr := strconv.ParseInt(r.FormValue("height"), 10, 64)
+		if parseErr != nil {
+			http.Error(w, "Invalid height", http.StatusBadRequest)
+			return
+		}
+
+		mined, err = bc.GetPoWBlock(height)
+	}
+
+	if err != nil {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+
+	view, err := newBlockView(mined)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, r, view)
+}
+
+// explorerTransaction returns the transaction with hex id ?id
+func explorerTransaction(w http.ResponseWriter, r *http.Request) {
+	txid, err := hex.DecodeString(r.FormValue("id"))
+	if err != nil || len(txid) == 0 {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	view, err := findTransaction(txid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeResponse(w, r, view)
+}
+
+// explorerAddress returns balance, nonce, burn and history of ?wallet
+func explorerAddress(w http.ResponseWriter, r *http.Request) {
+	address := r.FormValue("wallet")
+	if address == "" {
+		http.Error(w, "Missing wallet", http.StatusBadRequest)
+		return
+	}
+
+	err := wallet.ValidateAddress(address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := bc.NewBalanceState().GetWalletInfo(address)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	history, err := getAddressHistory(address)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, r, AddressView{
+		Wallet:     address,
+		Balance:    info.Balance,
+		Nonce:      info.Nonce,
+		Burn:       info.Burn,
+		BurnWeight: info.GetBurnAt(bc.GetLen() - 1),
+		History:    history,
+	})
+}
+
+// explorerLatest returns the last ?n blocks of the main chain, newest first
+func explorerLatest(w http.ResponseWriter, r *http.Request) {
+	n := int64(DEFAULT_LATEST_BLOCKS)
+	if r.FormValue("n") != "" {
+		parsed, err := strconv.ParseInt(r.FormValue("n"), 10, 64)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid n", http.StatusBadRequest)
+			return
+		}
+
+		n = parsed
+	}
+
+	if n > MAX_LATEST_BLOCKS {
+		n = MAX_LATEST_BLOCKS
+	}
+
+	// BSON documents can't be arrays
+	result := struct {
+		Blocks []*BlockView `bson:"b" json:"blocks"`
+	}{[]*BlockView{}}
+
+	for i := bc.GetLen() - 1; i >= 0 && int64(len(result.Blocks)) < n; i-- {
+		mined, err := bc.GetPoWBlock(i)
+		if err != nil {
+			log.Error(err)
+			break
+		}
+
+		view, err := newBlockView(mined)
+		if err != nil {
+			log.Error(err)
+			break
+		}
+
+		result.Blocks = append(result.Blocks, view)
+	}
+
+	writeResponse(w, r, result)
+}
+
+// explorerStats returns general information about the chain
+func explorerStats(w http.ResponseWriter, r *http.Request) {
+	tip, err := bc.GetTip()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	work, err := bc.GetWork(tip.Hash)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats := ChainStats{
+		Network:     params.Active.Name,
+		Height:      tip.Index,
+		TipHash:     hex.EncodeToString([]byte(tip.Hash)),
+		Difficulty:  tip.GetHeaderDifficulty().String(),
+		Work:        work.String(),
+		MempoolSize: pool.Len(),
+		GasPrice:    pool.EstimateFee().GasPrice,
+	}
+
+	// Average over the same window used to adjust the difficulty, the
+	// genesis timestamp is fixed so it's left out
+	if tip.Index > 1 {
+		start := tip.Index - blockchain.DIFFICULTY_WINDOW
+		if start < 1 {
+			start = 1
+		}
+
+		first, err := bc.GetBlock(start)
+		if err == nil {
+			stats.AverageBlockTime = (tip.Timestamp - first.Timestamp) / (tip.Index - start)
+		}
+	}
+
+	writeResponse(w, r, stats)
+}
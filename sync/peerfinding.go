@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/badlamb/dexm/params"
 	"gopkg.in/mgo.v2/bson"
 	log "github.com/sirupsen/logrus"
 )
@@ -37,7 +38,20 @@ func findPeers() {
 		// TODO clean up given IP and avoid getting tricked into ddosing a server
 		ip := string(iter.Key())
 
-		data, err := makeRequest("http://"+ip+PORT+"/getaddr", netClient)
+		// Peers on a chain with another genesis are useless, unreachable
+		// ones are tried again later
+		same, err := checkGenesis(ip, netClient)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		if !same {
+			nodeDatabase.Delete(iter.Key(), nil)
+			continue
+		}
+
+		data, err := makeRequest("http://"+ip+params.Active.Port+"/getaddr", netClient)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -55,11 +69,18 @@ func findPeers() {
 
 			_, err = nodeDatabase.Get([]byte(k), nil)
 			if err != nil {
-				nodeDatabase.Put([]byte(k), v, nil)
-
 				/* Once a new IP has been found contact it and ask it for the len of it's chain */
-				go func(k string) {
-					data, err := makeRequest("http://"+k+PORT+"/getlen", netClient)
+				go func(k string, v []byte) {
+					same, err := checkGenesis(k, netClient)
+					if err != nil {
+						log.Error(err)
+					} else if !same {
+						return
+					}
+
+					nodeDatabase.Put([]byte(k), v, nil)
+
+					data, err := makeRequest("http://"+k+params.Active.Port+"/getlen", netClient)
 					numOfBlocks, err := strconv.Atoi(string(data))
 					if err != nil {
 						log.Error(err)
@@ -70,7 +91,7 @@ func findPeers() {
 					if int64(numOfBlocks) > bc.GetLen() {
 						log.Info("Found peer with longer chain! Need to sync this amount of blocks:", int64(numOfBlocks)-bc.GetLen())
 					}
-				}(k)
+				}(k, v)
 
 				continue
 			}
@@ -80,6 +101,22 @@ func findPeers() {
 	iter.Release()
 }
 
+// Checks that a peer uses the same genesis block as this node, an error
+// means the peer couldn't be asked
+func checkGenesis(ip string, netClient *http.Client) (bool, error) {
+	data, err := makeRequest("http://"+ip+params.Active.Port+"/getgenesis", netClient)
+	if err != nil {
+		return false, err
+	}
+
+	if string(data) != params.Active.GenesisHash {
+		log.Warn("Peer ", ip, " has a different genesis block")
+		return false, nil
+	}
+
+	return true, nil
+}
+
 func AutoIPCleanup(){
 	for {
 		iter := nodeDatabase.NewIterator(nil, nil)
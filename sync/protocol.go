@@ -3,68 +3,101 @@ package protocol
 import (
 	"bytes"
 	"net"
-	"os"
 	"net/http"
 	"encoding/json"
 	"encoding/binary"
+	"encoding/hex"
 	"strconv"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
 	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/params"
 	"github.com/badlamb/dexm/wallet"
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
 	"io/ioutil"
 )
 
-const (
-	PORT = ":3141"
-)
-
 type Message struct {
-	Id   int
-	Data []byte
+	Id    int
+	Data  []byte
+	Magic []byte
 }
 
 var nodeDatabase *leveldb.DB
 var bc *blockchain.BlockChain
+var pool *mempool.Mempool
 
 // Opens the databases needed by many built in tools
 func InitPartialNode() {
-	if isFolder("blockchain.db"){
-		bc = blockchain.OpenBlockchain()
-	}else{
-		blockchain.NewBlockChain()
-	}
+	bc = blockchain.OpenBlockchain()
 
 	// TODO Add first peer insertion
-	nodeDatabase, _ = leveldb.OpenFile("ips.db", nil)
+	nodeDatabase, _ = leveldb.OpenFile(params.GetPath("ips.db"), nil)
+}
+
+// Opens the databases and the mempool used by a full node
+func InitFullNode() {
+	InitPartialNode()
+
+	// Transactions relayed by peers are kept here until they get mined
+	pool = mempool.NewMempool(bc)
+	go pool.AutoCleanup()
 }
 
-// Inspired by https://stackoverflow.com/questions/10510691/how-to-check-whether-a-file-or-directory-denoted-by-a-path-exists-in-golang
-func isFolder(path string) bool{
-	_, err := os.Stat(path)
-	if err != nil { return true }
-	if os.IsNotExist(err) { return false }
+// Returns the blockchain opened by InitPartialNode
+func GetBlockchain() *blockchain.BlockChain {
+	return bc
+}
 
-	return true
+// Returns the mempool opened by InitFullNode
+func GetMempool() *mempool.Mempool {
+	return pool
 }
 
 // Start a full node
 func StartSyncServer() {
 	log.Info("Opening node db..")
-	InitPartialNode()
+	InitFullNode()
+	ServeSync()
+}
 
+// Starts the sync webserver, InitFullNode has to be called first
+func ServeSync() {
 	/* This goroutine contacts known nodes and asks for their ip list */
 	go findPeers()
 
 	log.Info("Starting sync webserver...")
-	http.HandleFunc("/getaddr", getAddr)
-	http.HandleFunc("/getlen", getMaxBlock)
-	http.HandleFunc("/getblock", getBlock)
-	http.HandleFunc("/newmsg", getMessage)
-	http.ListenAndServe(PORT, nil)
+	http.ListenAndServe(params.Active.Port, NewSyncHandler())
+}
+
+// Returns the handler of the sync webserver, InitFullNode has to be called
+// first
+func NewSyncHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/getaddr", getAddr)
+	mux.HandleFunc("/getlen", getMaxBlock)
+	mux.HandleFunc("/getgenesis", getGenesis)
+	mux.HandleFunc("/getblock", getBlock)
+	mux.HandleFunc("/getproof", getProof)
+	mux.HandleFunc("/getstateproof", getStateProof)
+	mux.HandleFunc("/estimatefee", estimateFee)
+	mux.HandleFunc("/newmsg", getMessage)
+
+	// Read only API used by the block explorer
+	mux.HandleFunc("/explorer/block", explorerBlock)
+	mux.HandleFunc("/explorer/tx", explorerTransaction)
+	mux.HandleFunc("/explorer/address", explorerAddress)
+	mux.HandleFunc("/explorer/latest", explorerLatest)
+	mux.HandleFunc("/explorer/stats", explorerStats)
+
+	if params.Active.IsRegtest {
+		mux.HandleFunc("/generate", generate)
+	}
+
+	return mux
 }
 
 // getAddr is an http request that returns all known ips
@@ -117,11 +150,119 @@ func getBlock(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Response of /getproof
+type TransactionProof struct {
+	Index      int64                   `bson:"i" json:"index"`
+	MerkleRoot []byte                  `bson:"r" json:"root"`
+	Proof      *blockchain.MerkleProof `bson:"p" json:"proof"`
+}
+
+// getProof returns a merkle proof that the transaction with hex id ?txid is
+// in the main chain. If ?index is set only that block is searched, otherwise
+// the block is found with the indexes or by scanning the chain.
+func getProof(w http.ResponseWriter, r *http.Request) {
+	txid, err := hex.DecodeString(r.FormValue("txid"))
+	if err != nil || len(txid) == 0 {
+		http.Error(w, "Invalid txid", http.StatusBadRequest)
+		return
+	}
+
+	// Search from the tip, recent transactions are asked for more often
+	first, last := int64(0), bc.GetLen()-1
+	if r.FormValue("index") != "" {
+		index, err := strconv.Atoi(r.FormValue("index"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		first, last = int64(index), int64(index)
+	} else if bc.Index != nil {
+		height, _, err := bc.GetTransactionLocation(txid)
+		if err != nil {
+			http.Error(w, "Transaction not found", http.StatusNotFound)
+			return
+		}
+
+		first, last = height, height
+	}
+
+	for i := last; i >= first; i-- {
+		block, err := bc.GetBlock(i)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// The genesis has no real transactions
+		if block.Index == 0 {
+			continue
+		}
+
+		proof, err := block.GetMerkleProof(txid)
+		if err != nil {
+			continue
+		}
+
+		writeResponse(w, r, TransactionProof{
+			Index:      block.Index,
+			MerkleRoot: block.MerkleRoot,
+			Proof:      proof,
+		})
+		return
+	}
+
+	http.Error(w, "Transaction not found", http.StatusNotFound)
+}
+
+// getStateProof returns a proof of the balance, nonce and burn of ?wallet
+// against the state root of the last block
+func getStateProof(w http.ResponseWriter, r *http.Request) {
+	proof, err := bc.GetAccountProof(r.FormValue("wallet"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var value []byte
+	if r.URL.Query().Get("json") != "true" {
+		value, err = bson.Marshal(proof)
+	} else {
+		value, err = json.Marshal(proof)
+	}
+
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(value)
+}
+
+// estimateFee returns the suggested gas price based on recent blocks and
+// the mempool
+func estimateFee(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, pool.EstimateFee())
+}
+
 // Returns how many blocks the client knows
 func getMaxBlock(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(strconv.Itoa(int(bc.GetLen()))))
 }
 
+// Returns the hex encoded hash of the genesis block
+func getGenesis(w http.ResponseWriter, r *http.Request) {
+	hash, err := bc.GetGenesisHash()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(hash))
+}
+
 // getMessage recives messages from other known peers about events(transactions, blocks etc)
 func getMessage(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -137,6 +278,12 @@ func getMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Ignore peers on other networks
+	if !bytes.Equal(recived.Magic, params.Active.Magic[:]) {
+		log.Debug("Message from a different network")
+		return
+	}
+
 	res := false
 
 	// Transaction
@@ -148,10 +295,15 @@ func getMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		res, err = blockchain.VerifyTransactionSignature(t)
+		// Only relay transactions that made it into the mempool, this
+		// also stops already known transactions from being rebroadcast.
+		err = pool.AddTransaction(t)
 		if err != nil {
+			log.Debug(err)
 			return
 		}
+
+		res = true
 	}
 
 	// New block
@@ -163,11 +315,19 @@ func getMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		res, err = bc.VerifyNewBlockValidity(&newBlock)
+		err = bc.AddBlock(&newBlock)
 		if err != nil{
 			log.Error(err)
 			return
 		}
+
+		// Transactions in the block can't be mined again
+		transactions, err := blockchain.DecodeTransactions(newBlock.MinedBlock.TransactionList)
+		if err == nil {
+			pool.RemoveTransactions(transactions)
+		}
+
+		res = true
 	}
 
 	if res{
@@ -178,7 +338,7 @@ func getMessage(w http.ResponseWriter, r *http.Request) {
 // BroadcastMessage functions shares a message with other peers.
 // The algorithm isn't finalized yet and it's very innefficient.
 func BroadcastMessage(class int, data []byte) {
-	toSend := Message{Id: class, Data: data}
+	toSend := Message{Id: class, Data: data, Magic: params.Active.Magic[:]}
 	iter := nodeDatabase.NewIterator(nil, nil)
 
 	netTransport := &http.Transport{
@@ -195,7 +355,7 @@ func BroadcastMessage(class int, data []byte) {
 	bsonStr, _ := bson.Marshal(toSend)
 
 	for iter.Next() {
-		req, err := http.NewRequest("POST", "http://"+string(iter.Key())+PORT+"/newmsg", bytes.NewBuffer(bsonStr))
+		req, err := http.NewRequest("POST", "http://"+string(iter.Key())+params.Active.Port+"/newmsg", bytes.NewBuffer(bsonStr))
 		if err != nil {
 			continue
 		}
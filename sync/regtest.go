@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/badlamb/dexm/miner"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Most blocks a single /generate call can mine
+const MAX_GENERATE_BLOCKS = 1000
+
+// generate mines ?n blocks to ?address and returns their hex hashes. Only
+// served on regtest and only to local clients.
+func generate(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !net.ParseIP(host).IsLoopback() {
+		http.Error(w, "Only local clients can generate blocks", http.StatusForbidden)
+		return
+	}
+
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 || n > MAX_GENERATE_BLOCKS {
+		http.Error(w, "Invalid number of blocks", http.StatusBadRequest)
+		return
+	}
+
+	address := r.FormValue("address")
+	if address == "" {
+		address = wallet.GenerateWallet().GetWallet()
+	}
+
+	err = wallet.ValidateAddress(address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashes, err := miner.NewMiner(bc, pool, address, BroadcastMessage).Generate(n)
+
+	// BSON documents can't be arrays
+	result := struct {
+		Hashes []string `bson:"h" json:"hashes"`
+	}{[]string{}}
+
+	for _, v := range hashes {
+		result.Hashes = append(result.Hashes, hex.EncodeToString([]byte(v)))
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, r, result)
+}
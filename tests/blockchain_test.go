@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/params"
+)
+
+func TestMerkleProof(t *testing.T) {
+	leaves := [][]byte{}
+	for i := 0; i < 7; i++ {
+		leaves = append(leaves, []byte{byte(i)})
+	}
+
+	root := blockchain.MerkleRoot(leaves)
+
+	for k, v := range leaves {
+		proof, err := blockchain.NewMerkleProof(leaves, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !blockchain.VerifyMerkleProof(v, root, proof) {
+			t.Error("Valid proof rejected for leaf ", k)
+		}
+
+		if blockchain.VerifyMerkleProof([]byte("not a leaf"), root, proof) {
+			t.Error("Proof accepted for a different leaf")
+		}
+	}
+}
+
+func TestGenesisBlock(t *testing.T) {
+	networks := []*params.Network{params.Mainnet, params.Testnet, params.Regtest}
+
+	for _, v := range networks {
+		err := blockchain.VerifyGenesis(blockchain.GenesisBlock(v), v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPoWSchedule(t *testing.T) {
+	networks := []*params.Network{params.Mainnet, params.Testnet, params.Regtest}
+
+	for _, v := range networks {
+		err := blockchain.VerifyPoWSchedule(v.PoWSchedule)
+		if err != nil {
+			t.Error(v.Name, err)
+		}
+	}
+
+	regtest := *params.Regtest
+	err := blockchain.SetPoWSchedule(&regtest, []params.PoWActivation{
+		{Height: 0, Algorithm: params.POW_LYRA2REV2},
+		{Height: 10, Algorithm: params.POW_BLAKE2B},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := params.Active
+	params.Active = &regtest
+	defer func() { params.Active = active }()
+
+	expected := map[int64]string{0: params.POW_LYRA2REV2, 9: params.POW_LYRA2REV2, 10: params.POW_BLAKE2B, 1000: params.POW_BLAKE2B}
+	for height, name := range expected {
+		algorithm, err := blockchain.GetPoWAlgorithm(height)
+		if err != nil || algorithm.Name() != name {
+			t.Error("Wrong algorithm at height", height)
+		}
+	}
+
+	if blockchain.SetPoWSchedule(&regtest, []params.PoWActivation{{Height: 5, Algorithm: params.POW_BLAKE2B}}) == nil {
+		t.Error("Schedule not starting at height 0 accepted")
+	}
+}
+
+func TestPoBSelection(t *testing.T) {
+	accounts := []blockchain.AccountLeaf{}
+	for i := 0; i < 10; i++ {
+		accounts = append(accounts, blockchain.AccountLeaf{
+			Wallet: "Dexm" + string(rune('a'+i)),
+			Info:   blockchain.WalletInfo{Burn: 100},
+		})
+	}
+
+	seed := []byte("seed")
+	first := blockchain.SelectPoBWallets(accounts, seed, 0, 5)
+	second := blockchain.SelectPoBWallets(accounts, seed, 0, 5)
+
+	if len(first) != 5 {
+		t.Fatal("Expected 5 wallets, got", len(first))
+	}
+
+	seen := make(map[string]bool)
+	for k, v := range first {
+		if v != second[k] {
+			t.Error("Selection is not deterministic")
+		}
+
+		if seen[v] {
+			t.Error("Wallet", v, "was picked twice")
+		}
+		seen[v] = true
+	}
+
+	// Burns older than 64 half lives have no weight left
+	result := blockchain.SelectPoBWallets(accounts, seed, 64*blockchain.BURN_HALF_LIFE, 5)
+	if len(result) != 0 {
+		t.Error("Decayed burns were selected")
+	}
+}
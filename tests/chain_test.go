@@ -0,0 +1,457 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/miner"
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Switches to a private copy of regtest where every wallet starts with
+// 100 coins, the returned function switches back.
+func useRegtest(t *testing.T, funded ...*wallet.Wallet) func() {
+	active, dataDir := params.Active, params.DataDir
+
+	net := *params.Regtest
+	params.Active = &net
+
+	allocations := []params.Allocation{}
+	for _, v := range funded {
+		allocations = append(allocations, params.Allocation{Address: v.GetWallet(), Amount: 100 * coin.COIN})
+		v.Balance = 100 * coin.COIN
+	}
+
+	err := blockchain.SetGenesisAllocations(&net, allocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		params.Active = active
+		params.DataDir = dataDir
+	}
+}
+
+// Creates a regtest chain in a temporary folder that is removed when the
+// test ends
+func newChain(t *testing.T) *blockchain.BlockChain {
+	dir, err := ioutil.TempDir("", "dexm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = params.SetDataDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := blockchain.OpenBlockchain()
+	t.Cleanup(func() {
+		closeChain(bc)
+		os.RemoveAll(dir)
+	})
+
+	return bc
+}
+
+// Closes a test chain and opens it again from its folder
+func reopen(t *testing.T, bc *blockchain.BlockChain) *blockchain.BlockChain {
+	closeChain(bc)
+
+	reopened := blockchain.OpenBlockchain()
+	t.Cleanup(func() {
+		closeChain(reopened)
+	})
+
+	return reopened
+}
+
+func closeChain(bc *blockchain.BlockChain) {
+	bc.DB.Close()
+	bc.Balances.Close()
+	bc.State.Close()
+	if bc.Index != nil {
+		bc.Index.Close()
+	}
+}
+
+// Mines n blocks to address with the given transactions in the first one
+func generate(t *testing.T, bc *blockchain.BlockChain, address string, n int, transactions ...wallet.Transaction) {
+	pool := mempool.NewMempool(bc)
+	for _, v := range transactions {
+		err := pool.AddTransaction(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := miner.NewMiner(bc, pool, address, func(int, []byte) {}).Generate(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectBalance(t *testing.T, bc *blockchain.BlockChain, address string, expected coin.Amount) {
+	balance, _, _ := bc.GetBalance(address)
+	if balance != expected {
+		t.Errorf("Balance of %s is %s, expected %s", address, balance, expected)
+	}
+}
+
+func TestReorganization(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	recipient := wallet.GenerateWallet().GetWallet()
+	minerA := wallet.GenerateWallet().GetWallet()
+	minerB := wallet.GenerateWallet().GetWallet()
+
+	reward, err := blockchain.GetReward(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := sender.NewTransaction(recipient, 10*coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The main chain has 2 blocks, the other branch 4 blocks and a
+	// transaction
+	main := newChain(t)
+	generate(t, main, minerA, 2)
+
+	branch := newChain(t)
+	generate(t, branch, minerB, 4, tx)
+
+	var exported bytes.Buffer
+	_, err = branch.ExportChain(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = main.ImportChain(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if main.GetLen() != 5 {
+		t.Fatalf("Chain has %d blocks after the reorganization", main.GetLen())
+	}
+
+	minerReward, err := reward.Mul(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectBalance(t, main, minerA, 0)
+	expectBalance(t, main, minerB, minerReward+1000)
+	expectBalance(t, main, recipient, 10*coin.COIN)
+	expectBalance(t, main, sender.GetWallet(), 90*coin.COIN-1000)
+
+	report, err := main.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.FirstBadBlock != -1 || report.DivergentAccount != "" {
+		t.Errorf("Chain is not consistent after the reorganization: %+v", *report)
+	}
+}
+
+func TestConcurrentBlocks(t *testing.T) {
+	defer useRegtest(t)()
+
+	reward, err := blockchain.GetReward(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Competing children of the genesis, mined on separate chains
+	miners := []string{}
+	blocks := []*blockchain.PoWBlock{}
+	for i := 0; i < 8; i++ {
+		address := wallet.GenerateWallet().GetWallet()
+		source := newChain(t)
+		generate(t, source, address, 1)
+
+		block, err := source.GetPoWBlock(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		miners = append(miners, address)
+		blocks = append(blocks, block)
+	}
+
+	bc := newChain(t)
+
+	// All blocks are added at once, each one used to see the genesis as
+	// the tip and credit its miner
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, v := range blocks {
+		wg.Add(1)
+		go func(block *blockchain.PoWBlock) {
+			defer wg.Done()
+			<-start
+			bc.AddBlock(block)
+		}(v)
+	}
+	close(start)
+	wg.Wait()
+
+	// Only the block that was added first is on the main chain
+	winner, err := bc.GetBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range miners {
+		if v == winner.Miner {
+			expectBalance(t, bc, v, reward)
+		} else {
+			expectBalance(t, bc, v, 0)
+		}
+	}
+
+	report, err := bc.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.FirstBadBlock != -1 || report.DivergentAccount != "" {
+		t.Errorf("Chain is not consistent: %+v", *report)
+	}
+}
+
+func TestAccountProof(t *testing.T) {
+	funded := []*wallet.Wallet{wallet.GenerateWallet(), wallet.GenerateWallet(), wallet.GenerateWallet()}
+	defer useRegtest(t, funded...)()
+
+	bc := newChain(t)
+	generate(t, bc, funded[0].GetWallet(), 2)
+
+	tip, err := bc.GetTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range funded {
+		proof, err := bc.GetAccountProof(v.GetWallet())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if proof.Missing || !blockchain.VerifyAccountProof(proof, tip.StateRoot) {
+			t.Error("Valid proof rejected for", v.GetWallet())
+		}
+
+		proof.Account.Info.Balance++
+		if blockchain.VerifyAccountProof(proof, tip.StateRoot) {
+			t.Error("Proof accepted with a different balance")
+		}
+	}
+
+	proof, err := bc.GetAccountProof(wallet.GenerateWallet().GetWallet())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !proof.Missing || !blockchain.VerifyAccountProof(proof, tip.StateRoot) {
+		t.Error("Valid proof of a missing wallet rejected")
+	}
+
+	proof.Account.Info.Balance = 1
+	if blockchain.VerifyAccountProof(proof, tip.StateRoot) {
+		t.Error("Missing wallet proven to have a balance")
+	}
+
+	// Older states can still be read
+	genesis, err := bc.GetBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := bc.GetAccounts(genesis.StateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accounts) != len(funded) {
+		t.Errorf("Genesis state has %d wallets", len(accounts))
+	}
+
+	for _, v := range accounts {
+		if v.Info.Balance != 100*coin.COIN {
+			t.Errorf("Genesis balance of %s is %s", v.Wallet, v.Info.Balance)
+		}
+	}
+}
+
+func TestPoBWalletsAtBlock(t *testing.T) {
+	burner := wallet.GenerateWallet()
+	defer useRegtest(t, burner)()
+
+	bc := newChain(t)
+
+	tx, err := burner.NewTransaction(wallet.BurnAddress(), coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1, tx)
+
+	burnt, err := bc.GetBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := bc.GetPoBWallets(burnt.Hash, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(selected) != 1 || selected[0] != burner.GetWallet() {
+		t.Fatal("Burner wasn't selected, got", selected)
+	}
+
+	// Later blocks don't change the selection for an older one
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 3)
+
+	again, err := bc.GetPoBWallets(burnt.Hash, 5)
+	if err != nil || len(again) != 1 || again[0] != selected[0] {
+		t.Error("Selection changed after new blocks")
+	}
+
+	genesis, err := bc.GetBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	none, err := bc.GetPoBWallets(genesis.Hash, 5)
+	if err != nil || len(none) != 0 {
+		t.Error("Wallets selected before any burn")
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	defer useRegtest(t)()
+
+	// Blocks are mined on regtest, the difficulty is computed as on the
+	// other networks
+	net := params.Active
+	net.GenesisDifficulty = 16
+	err := blockchain.SetGenesisAllocations(net, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := newChain(t)
+	difficulty := func() int64 {
+		b, err := bc.NewBlock(nil, nil, wallet.GenerateWallet().GetWallet())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		net.IsRegtest = false
+		defer func() { net.IsRegtest = true }()
+
+		d, err := b.GetDifficulty(bc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d.Int64()
+	}
+
+	// The old genesis timestamp doesn't make the first blocks easier
+	for i := 0; i <= blockchain.DIFFICULTY_WINDOW; i++ {
+		if d := difficulty(); d != 16 {
+			t.Fatalf("Difficulty of block %d is %d before a full window", i+1, d)
+		}
+
+		generate(t, bc, wallet.GenerateWallet().GetWallet(), 1)
+	}
+
+	// A window mined at once is as hard as the adjustment allows
+	if d := difficulty(); d != 16*blockchain.MAX_DIFFICULTY_ADJUSTMENT {
+		t.Errorf("Difficulty after a fast window is %d", d)
+	}
+}
+
+func TestOpenNewChain(t *testing.T) {
+	miner := wallet.GenerateWallet()
+	defer useRegtest(t, miner)()
+
+	// Tools open the chain without creating it first
+	bc := newChain(t)
+	if bc.GetLen() != 1 {
+		t.Fatalf("New chain has %d blocks", bc.GetLen())
+	}
+
+	expectBalance(t, bc, miner.GetWallet(), 100*coin.COIN)
+	generate(t, bc, miner.GetWallet(), 1)
+
+	reopened := reopen(t, bc)
+	if reopened.GetLen() != 2 {
+		t.Errorf("Reopened chain has %d blocks", reopened.GetLen())
+	}
+}
+
+func TestForgetDescendants(t *testing.T) {
+	defer useRegtest(t)()
+
+	bc := newChain(t)
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 3)
+
+	// Side branch on the genesis, its first block has a wrong state root
+	other := newChain(t)
+	invalid := candidate(t, other)
+	invalid.MinedBlock.StateRoot = make([]byte, 32)
+	invalid.MinedBlock.Hash = invalid.MinedBlock.CalculateHash()
+
+	child := func(parent *blockchain.PoWBlock, seconds int64) *blockchain.PoWBlock {
+		b := *parent.MinedBlock
+		b.Index++
+		b.PreviousBlockHash = parent.MinedBlock.Hash
+		b.Timestamp += seconds
+		b.Hash = b.CalculateHash()
+
+		return &blockchain.PoWBlock{Nonce: []byte{0}, MinedBlock: &b}
+	}
+
+	// A dead end and a branch that gets heavy enough to be applied
+	deadEnd := child(invalid, 1)
+	branch := []*blockchain.PoWBlock{invalid, deadEnd, child(invalid, 2)}
+	for i := 0; i < 2; i++ {
+		branch = append(branch, child(branch[len(branch)-1], 1))
+	}
+
+	for _, v := range branch[:len(branch)-1] {
+		err := bc.AddBlock(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectRule(t, bc.AddBlock(branch[len(branch)-1]), blockchain.RULE_STATE_ROOT)
+
+	for _, v := range branch {
+		if bc.HasBlock(v.MinedBlock.Hash) {
+			t.Errorf("Block %d of the invalid branch is still stored", v.MinedBlock.Index)
+		}
+	}
+
+	if bc.GetLen() != 4 {
+		t.Errorf("Chain has %d blocks", bc.GetLen())
+	}
+}
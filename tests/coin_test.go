@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/badlamb/dexm/coin"
+)
+
+func TestAmountParsing(t *testing.T) {
+	amounts := map[string]coin.Amount{
+		"0":          0,
+		"1":          coin.COIN,
+		"0.5":        coin.COIN / 2,
+		"12.3":       12*coin.COIN + 30000000,
+		"0.00000001": 1,
+	}
+
+	for k, v := range amounts {
+		parsed, err := coin.Parse(k)
+		if err != nil || parsed != v {
+			t.Error("Wrong value parsing", k, parsed, err)
+		}
+
+		if v.String() != k {
+			t.Error("Wrong format of", k, v.String())
+		}
+	}
+
+	for _, v := range []string{"", "-1", "1.", ".5", "1.000000001", "1e5", "92233720369"} {
+		if _, err := coin.Parse(v); err == nil {
+			t.Error("Invalid amount accepted", v)
+		}
+	}
+}
+
+func TestAmountOverflow(t *testing.T) {
+	if _, err := coin.MAX_AMOUNT.Add(1); err != coin.ErrOverflow {
+		t.Error("Add doesn't overflow")
+	}
+
+	if _, err := coin.COIN.Sub(coin.COIN + 1); err != coin.ErrNegative {
+		t.Error("Sub goes below zero")
+	}
+
+	if _, err := coin.COIN.Mul(1 << 40); err != coin.ErrOverflow {
+		t.Error("Mul doesn't overflow")
+	}
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/sync"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Asks the explorer API of the sync server for a json value
+func explorerGet(t *testing.T, handler http.Handler, path string, value interface{}) {
+	req := httptest.NewRequest("GET", path+"&json=true", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s returned %d: %s", path, rec.Code, rec.Body.String())
+	}
+
+	err := json.Unmarshal(rec.Body.Bytes(), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExplorerWithoutIndexes(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	recipient := wallet.GenerateWallet().GetWallet()
+	miner := wallet.GenerateWallet().GetWallet()
+
+	tx, err := sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := newChain(t)
+	generate(t, bc, miner, 2, tx)
+	closeChain(bc)
+
+	// The node opens the same folder, indexes are off
+	protocol.InitFullNode()
+	t.Cleanup(func() {
+		closeChain(protocol.GetBlockchain())
+	})
+
+	if protocol.GetBlockchain().Index != nil {
+		t.Fatal("Indexes were opened")
+	}
+
+	handler := protocol.NewSyncHandler()
+
+	var view protocol.TransactionView
+	explorerGet(t, handler, "/explorer/tx?id="+hex.EncodeToString(tx.GetHash()), &view)
+
+	if view.BlockIndex != 1 || view.Recipient != recipient || view.Amount != coin.COIN {
+		t.Errorf("Transaction found as %+v", view)
+	}
+
+	var address protocol.AddressView
+	explorerGet(t, handler, "/explorer/address?wallet="+recipient, &address)
+
+	if address.Balance != coin.COIN || len(address.History) != 1 || address.History[0].Role != "received" {
+		t.Errorf("Recipient found as %+v", address)
+	}
+
+	explorerGet(t, handler, "/explorer/address?wallet="+miner, &address)
+	if len(address.History) != 2 || address.History[0].BlockIndex != 2 || address.History[0].Role != "mined" {
+		t.Errorf("Miner found as %+v", address)
+	}
+}
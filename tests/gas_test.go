@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/wallet"
+)
+
+func TestTransactionGas(t *testing.T) {
+	plain := wallet.Transaction{
+		Sender:      make([]byte, 91),
+		Recipient:   "Dexm" + strings.Repeat("x", 35),
+		Amount:      coin.COIN,
+		Gas:         1000,
+		SenderNonce: 1,
+		Timestamp:   1519862400,
+		SenderSig:   [2][]byte{make([]byte, 32), make([]byte, 32)},
+	}
+
+	// The base gas and 3 started blocks of 100 bytes
+	if gas := blockchain.GetTransactionGas(plain); gas != 4 {
+		t.Errorf("Transfer uses %d gas", gas)
+	}
+
+	// The contract isn't counted in the size, it pays for 25 byte blocks
+	contract := plain
+	contract.Contract = make([]byte, 1000)
+
+	if gas := blockchain.GetTransactionGas(contract); gas != 44 {
+		t.Errorf("Contract transaction uses %d gas", gas)
+	}
+}
+
+func TestGasEstimate(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	pool := mempool.NewMempool(newChain(t))
+	estimate := pool.EstimateFee()
+
+	code := []byte(strings.Repeat("x", 1000))
+	for i := 0; i < 20; i++ {
+		transfer, err := sender.NewTransaction(wallet.GenerateWallet().GetWallet(), coin.COIN, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gas := blockchain.GetTransactionGas(transfer)
+		if gas > blockchain.EstimateTransactionGas(nil) || gas > estimate.TransferGas {
+			t.Errorf("Transfer uses %d gas, more than the estimate", gas)
+		}
+
+		fee, err := estimate.GasPrice.Mul(int64(gas))
+		if err != nil || fee > estimate.TransferFee {
+			t.Errorf("Transfer costs %s, more than the estimated %s", fee, estimate.TransferFee)
+		}
+
+		contract, err := sender.NewContractTransaction(wallet.GenerateWallet().GetWallet(), coin.COIN, 1000, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gas := blockchain.GetTransactionGas(contract); gas > blockchain.EstimateTransactionGas(code) {
+			t.Errorf("Contract transaction uses %d gas, more than the estimate", gas)
+		}
+	}
+}
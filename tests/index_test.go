@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Turns indexes on until the returned function is called
+func useIndexes() func() {
+	params.TxIndex = true
+	return func() {
+		params.TxIndex = false
+	}
+}
+
+func expectIndexed(t *testing.T, bc *blockchain.BlockChain, tx wallet.Transaction, height int64) {
+	found, b, err := bc.GetTransaction(tx.GetHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Index != height || !bytes.Equal(found.GetHash(), tx.GetHash()) {
+		t.Errorf("Transaction found in block %d, expected %d", b.Index, height)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+	defer useIndexes()()
+
+	bc := newChain(t)
+	if bc.Index == nil {
+		t.Fatal("Indexes weren't opened")
+	}
+
+	recipient := wallet.GenerateWallet().GetWallet()
+	miner := wallet.GenerateWallet().GetWallet()
+
+	transfer, err := sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	burn, err := sender.NewTransaction(wallet.BurnAddress(), coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, bc, miner, 1, transfer, burn)
+	expectIndexed(t, bc, transfer, 1)
+	expectIndexed(t, bc, burn, 1)
+
+	roles := map[string][]byte{
+		sender.GetWallet(): {blockchain.ROLE_BURNED, blockchain.ROLE_SENT},
+		recipient:          {blockchain.ROLE_RECEIVED},
+		miner:              {blockchain.ROLE_MINED},
+	}
+
+	for address, expected := range roles {
+		history, err := bc.GetAddressHistory(address, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(history) != len(expected) {
+			t.Errorf("History of %s has %d entries", address, len(history))
+			continue
+		}
+
+		// Newest first
+		for k, v := range history {
+			if v.Role != expected[k] || v.Height != 1 {
+				t.Errorf("Entry %d of %s is %s at height %d", k, address, blockchain.RoleNames[v.Role], v.Height)
+			}
+		}
+	}
+
+	// Disconnected blocks are removed
+	err = bc.Rollback(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = bc.GetTransactionLocation(transfer.GetHash())
+	if err == nil {
+		t.Error("Rolled back transaction is still indexed")
+	}
+
+	history, err := bc.GetAddressHistory(miner, 10)
+	if err != nil || len(history) != 0 {
+		t.Error("Rolled back reward is still indexed")
+	}
+}
+
+func TestReindex(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+	defer useIndexes()()
+
+	bc := newChain(t)
+
+	first, err := sender.NewTransaction(wallet.GenerateWallet().GetWallet(), coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1, first)
+
+	// Blocks added while indexes are off leave them behind the tip
+	params.TxIndex = false
+	bc = reopen(t, bc)
+
+	second, err := sender.NewTransaction(wallet.GenerateWallet().GetWallet(), coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1, second)
+
+	params.TxIndex = true
+	bc = reopen(t, bc)
+
+	if bc.Index != nil {
+		t.Fatal("Indexes built for another tip were opened")
+	}
+
+	_, _, err = bc.GetTransaction(first.GetHash())
+	if err == nil {
+		t.Error("Transaction found without indexes")
+	}
+
+	err = bc.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectIndexed(t, bc, first, 1)
+	expectIndexed(t, bc, second, 2)
+
+	// Rebuilt indexes match the tip and are used again
+	bc = reopen(t, bc)
+	if bc.Index == nil {
+		t.Fatal("Rebuilt indexes weren't opened")
+	}
+
+	expectIndexed(t, bc, second, 2)
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Signs a transaction with the next nonce of the sender
+func send(t *testing.T, sender *wallet.Wallet, gas coin.Amount) wallet.Transaction {
+	tx, err := sender.NewTransaction(wallet.GenerateWallet().GetWallet(), 1, gas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func TestMempoolReplacement(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	pool := mempool.NewMempool(newChain(t))
+
+	first := send(t, sender, 1000)
+	err := pool.AddTransaction(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same nonce, the gas has to go up
+	sender.Nonce--
+	cheaper := send(t, sender, 1000)
+	if pool.AddTransaction(cheaper) == nil {
+		t.Error("Replacement with the same gas accepted")
+	}
+
+	sender.Nonce--
+	better := send(t, sender, 2000)
+	err = pool.AddTransaction(better)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := pool.SelectTransactions(10)
+	if pool.Len() != 1 || len(selected) != 1 || selected[0].Gas != 2000 {
+		t.Errorf("Pool has %d transactions after a replacement", pool.Len())
+	}
+}
+
+func TestMempoolOrdering(t *testing.T) {
+	a, b := wallet.GenerateWallet(), wallet.GenerateWallet()
+	defer useRegtest(t, a, b)()
+
+	pool := mempool.NewMempool(newChain(t))
+
+	// The second transaction of a pays the most, but can't go before the
+	// first one
+	transactions := []wallet.Transaction{send(t, a, 1000), send(t, a, 100000), send(t, b, 10000)}
+	for _, v := range transactions {
+		err := pool.AddTransaction(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	selected := pool.SelectTransactions(10)
+	if len(selected) != 3 {
+		t.Fatalf("Selected %d transactions", len(selected))
+	}
+
+	for k, v := range []coin.Amount{10000, 1000, 100000} {
+		if selected[k].Gas != v {
+			t.Errorf("Transaction %d pays %s, expected %s", k, selected[k].Gas, v)
+		}
+	}
+
+	if len(pool.SelectTransactions(2)) != 2 {
+		t.Error("Selection isn't limited")
+	}
+}
+
+func TestMempoolEviction(t *testing.T) {
+	a, b := wallet.GenerateWallet(), wallet.GenerateWallet()
+	defer useRegtest(t, a, b)()
+
+	pool := mempool.NewMempool(newChain(t))
+
+	// Only the last transaction of a is cheap enough to be evicted
+	for i := 1; i <= mempool.MAX_POOL_SIZE; i++ {
+		gas := coin.Amount(5000)
+		if i == mempool.MAX_POOL_SIZE {
+			gas = 1000
+		}
+
+		err := pool.AddTransaction(send(t, a, gas))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pool.AddTransaction(send(t, b, 100)) == nil {
+		t.Error("Transaction paying less than the pool accepted")
+	}
+
+	b.Nonce--
+	err := pool.AddTransaction(send(t, b, 100000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.Len() != mempool.MAX_POOL_SIZE {
+		t.Errorf("Full pool has %d transactions", pool.Len())
+	}
+
+	for _, v := range pool.SelectTransactions(pool.Len()) {
+		if v.Gas == 1000 {
+			t.Error("Cheapest transaction wasn't evicted")
+		}
+	}
+}
+
+func TestMempoolCleanup(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	bc := newChain(t)
+	pool := mempool.NewMempool(bc)
+
+	mined, pending := send(t, sender, 1000), send(t, sender, 1000)
+	for _, v := range []wallet.Transaction{mined, pending} {
+		err := pool.AddTransaction(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1, mined)
+	pool.Cleanup()
+
+	selected := pool.SelectTransactions(10)
+	if pool.Len() != 1 || len(selected) != 1 || selected[0].SenderNonce != pending.SenderNonce {
+		t.Errorf("Pool has %d transactions after the block", pool.Len())
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Copies balances.db, keys are wallets and the state root
+func snapshotBalances(t *testing.T, bc *blockchain.BlockChain) map[string]string {
+	result := make(map[string]string)
+
+	iter := bc.Balances.NewIterator(nil, nil)
+	for iter.Next() {
+		result[string(iter.Key())] = string(iter.Value())
+	}
+	iter.Release()
+
+	if iter.Error() != nil {
+		t.Fatal(iter.Error())
+	}
+
+	return result
+}
+
+func TestRollback(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	bc := newChain(t)
+	generate(t, bc, sender.GetWallet(), 1)
+
+	balances := snapshotBalances(t, bc)
+	root, err := bc.GetStateRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New wallets, a burn and a reward for a known wallet
+	transfer, err := sender.NewTransaction(wallet.GenerateWallet().GetWallet(), coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	burn, err := sender.NewTransaction(wallet.BurnAddress(), coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1, transfer)
+	generate(t, bc, sender.GetWallet(), 1, burn)
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1)
+
+	err = bc.Rollback(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bc.GetLen() != 2 {
+		t.Fatalf("Chain has %d blocks after the rollback", bc.GetLen())
+	}
+
+	after := snapshotBalances(t, bc)
+	if len(after) != len(balances) {
+		t.Errorf("Rollback left %d wallets instead of %d", len(after), len(balances))
+	}
+
+	for k, v := range balances {
+		if after[k] != v {
+			t.Error("Wallet", k, "wasn't restored")
+		}
+	}
+
+	restored, err := bc.GetStateRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, root) {
+		t.Error("State root wasn't restored")
+	}
+}
@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/badlamb/dexm/blockchain"
+	"github.com/badlamb/dexm/coin"
+	"github.com/badlamb/dexm/mempool"
+	"github.com/badlamb/dexm/params"
+	"github.com/badlamb/dexm/wallet"
+)
+
+// Builds a block on the tip, regtest accepts any nonce
+func candidate(t *testing.T, bc *blockchain.BlockChain) *blockchain.PoWBlock {
+	b, err := bc.NewBlock(nil, nil, wallet.GenerateWallet().GetWallet())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &blockchain.PoWBlock{Nonce: []byte{0}, MinedBlock: b}
+}
+
+// Replaces the transactions of a block, keeping its merkle root valid
+func setTransactions(t *testing.T, b *blockchain.Block, transactions ...wallet.Transaction) {
+	list, err := blockchain.EncodeTransactions(transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.TransactionList = list
+	b.MerkleRoot, err = b.ComputeMerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectRule(t *testing.T, err error, rule string) {
+	invalid, ok := err.(*blockchain.BlockValidationError)
+	if !ok {
+		t.Errorf("Expected rule %s, got %v", rule, err)
+		return
+	}
+
+	if invalid.Rule != rule {
+		t.Errorf("Expected rule %s, got %s", rule, invalid.Rule)
+	}
+}
+
+func TestNonces(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	bc := newChain(t)
+	recipient := wallet.GenerateWallet().GetWallet()
+
+	first, err := sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, bc, recipient, 1, first)
+
+	_, err = bc.NewBalanceState().ApplyTransaction(first)
+	if err != blockchain.ErrNonceUsed {
+		t.Error("Replayed transaction returned", err)
+	}
+
+	_, err = sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bc.NewBalanceState().ApplyTransaction(third)
+	if err != blockchain.ErrNonceGap {
+		t.Error("Transaction after a gap returned", err)
+	}
+}
+
+func TestBlockRules(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	bc := newChain(t)
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1)
+
+	recipient := wallet.GenerateWallet().GetWallet()
+	transfer, err := sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contract, err := sender.NewContractTransaction(recipient, coin.COIN, coin.COIN, []byte(strings.Repeat("x", 300000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed, but the earlier nonces of the sender were never used
+	skipping, err := sender.NewTransaction(recipient, coin.COIN, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := candidate(t, bc)
+	err = bc.AddBlock(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis, err := bc.GetBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := map[string]func(b *blockchain.Block){
+		blockchain.RULE_ORPHAN:      func(b *blockchain.Block) { b.PreviousBlockHash = "unknown" },
+		blockchain.RULE_INDEX:       func(b *blockchain.Block) { b.Index++ },
+		blockchain.RULE_MINER:       func(b *blockchain.Block) { b.Miner = "Dexr" },
+		blockchain.RULE_SIZE:        func(b *blockchain.Block) { b.TransactionList = make([]byte, blockchain.MAX_BLOCK_SIZE) },
+		blockchain.RULE_TIMESTAMP:   func(b *blockchain.Block) { b.Timestamp = genesis.Timestamp },
+		blockchain.RULE_DIFFICULTY:  func(b *blockchain.Block) { b.Difficulty = big.NewInt(2).Bytes() },
+		blockchain.RULE_MERKLE_ROOT: func(b *blockchain.Block) { b.MerkleRoot = []byte("root") },
+		blockchain.RULE_STATE_ROOT:  func(b *blockchain.Block) { b.StateRoot = make([]byte, 32) },
+
+		blockchain.RULE_DUPLICATE_TX: func(b *blockchain.Block) { setTransactions(t, b, transfer, transfer) },
+		blockchain.RULE_BLOCK_GAS:    func(b *blockchain.Block) { setTransactions(t, b, contract) },
+		blockchain.RULE_TRANSACTIONS: func(b *blockchain.Block) { setTransactions(t, b, skipping) },
+	}
+
+	for rule, change := range rules {
+		mined := candidate(t, bc)
+		change(mined.MinedBlock)
+		mined.MinedBlock.Hash = mined.MinedBlock.CalculateHash()
+
+		expectRule(t, bc.AddBlock(mined), rule)
+	}
+
+	// Rules that can't be broken by changing a valid block and hashing it
+	expectRule(t, bc.AddBlock(&blockchain.PoWBlock{}), blockchain.RULE_MISSING_BLOCK)
+	expectRule(t, bc.AddBlock(known), blockchain.RULE_KNOWN_BLOCK)
+
+	wrongHash := candidate(t, bc)
+	wrongHash.MinedBlock.Hash = "hash"
+	expectRule(t, bc.AddBlock(wrongHash), blockchain.RULE_HASH)
+
+	future := candidate(t, bc)
+	future.MinedBlock.Timestamp = time.Now().Unix() + 2*blockchain.MAX_FUTURE_BLOCK_TIME
+	future.MinedBlock.Hash = future.MinedBlock.CalculateHash()
+	expectRule(t, bc.AddBlock(future), blockchain.RULE_TIMESTAMP)
+
+	// With a high difficulty a random nonce has no chance
+	params.Active.GenesisDifficulty = 1 << 62
+	err = blockchain.SetGenesisAllocations(params.Active, params.Active.Allocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hard := newChain(t)
+	expectRule(t, hard.AddBlock(candidate(t, hard)), blockchain.RULE_POW)
+
+	// Nothing was added by the invalid blocks
+	if bc.GetLen() != 3 {
+		t.Errorf("Chain has %d blocks", bc.GetLen())
+	}
+}
+
+func TestLocks(t *testing.T) {
+	now := time.Now().Unix()
+
+	// Locks below the threshold are heights, the others Unix times
+	cases := []struct {
+		lock, height, timestamp int64
+		locked                  bool
+	}{
+		{0, 0, 0, false},
+		{10, 9, now, true},
+		{10, 10, 0, false},
+		{wallet.LOCK_TIME_THRESHOLD - 1, wallet.LOCK_TIME_THRESHOLD - 2, now, true},
+		{wallet.LOCK_TIME_THRESHOLD - 1, wallet.LOCK_TIME_THRESHOLD - 1, 0, false},
+		{now, wallet.LOCK_TIME_THRESHOLD, now - 1, true},
+		{now, 0, now, false},
+	}
+
+	for _, v := range cases {
+		err := blockchain.CheckLock(wallet.Transaction{Lock: v.lock}, v.height, v.timestamp)
+		if v.locked && err != blockchain.ErrLocked {
+			t.Errorf("Lock %d accepted at height %d and time %d", v.lock, v.height, v.timestamp)
+		}
+
+		if !v.locked && err != nil {
+			t.Errorf("Lock %d refused at height %d and time %d: %v", v.lock, v.height, v.timestamp, err)
+		}
+	}
+}
+
+func TestLockedTransactions(t *testing.T) {
+	sender := wallet.GenerateWallet()
+	defer useRegtest(t, sender)()
+
+	bc := newChain(t)
+	pool := mempool.NewMempool(bc)
+	recipient := wallet.GenerateWallet().GetWallet()
+
+	byHeight, err := sender.NewLockedTransaction(recipient, coin.COIN, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byTime, err := sender.NewLockedTransaction(recipient, coin.COIN, 1000, time.Now().Unix()+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next block is 1
+	err = pool.AddTransaction(byHeight)
+	if err != blockchain.ErrLocked {
+		t.Error("Transaction locked until block 3 added to the mempool:", err)
+	}
+
+	locked := candidate(t, bc)
+	setTransactions(t, locked.MinedBlock, byHeight)
+	locked.MinedBlock.Hash = locked.MinedBlock.CalculateHash()
+	expectRule(t, bc.AddBlock(locked), blockchain.RULE_TRANSACTIONS)
+
+	// Block 3 is the first that can include it
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 2)
+
+	err = pool.AddTransaction(byHeight)
+	if err != nil {
+		t.Fatal("Transaction refused at its lock height:", err)
+	}
+
+	generate(t, bc, wallet.GenerateWallet().GetWallet(), 1, byHeight)
+	expectBalance(t, bc, recipient, coin.COIN)
+
+	// Time locks are checked against the block timestamp
+	err = pool.AddTransaction(byTime)
+	if err != blockchain.ErrLocked {
+		t.Error("Transaction locked for an hour added to the mempool:", err)
+	}
+
+	locked = candidate(t, bc)
+	setTransactions(t, locked.MinedBlock, byTime)
+	locked.MinedBlock.Hash = locked.MinedBlock.CalculateHash()
+	expectRule(t, bc.AddBlock(locked), blockchain.RULE_TRANSACTIONS)
+}
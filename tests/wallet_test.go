@@ -4,6 +4,7 @@ import (
     "os"
     "testing"
 
+    "github.com/badlamb/dexm/blockchain"
     "github.com/badlamb/dexm/wallet"
     "github.com/badlamb/dexm/sync"
 )
@@ -27,6 +28,66 @@ func TestWallet(t *testing.T) {
     imp.Sign([]byte("hh"))
 }
 
+func TestValidateAddress(t *testing.T) {
+    address := wallet.GenerateWallet().GetWallet()
+    if err := wallet.ValidateAddress(address); err != nil {
+        t.Error("Valid address is rejected", err)
+    }
+
+    if err := wallet.ValidateAddress(wallet.BurnAddress()); err != nil {
+        t.Error("Burn address is rejected", err)
+    }
+
+    // Swap two characters of the body
+    typo := []byte(address)
+    typo[5], typo[6] = typo[6], typo[5]
+    if typo[5] != typo[6] && wallet.ValidateAddress(string(typo)) == nil {
+        t.Error("Address with a typo is accepted")
+    }
+
+    if wallet.ValidateAddress("Dext" + address[4:]) == nil {
+        t.Error("Address of another network is accepted")
+    }
+}
+
+func TestMultisig(t *testing.T) {
+    first := wallet.GenerateWallet()
+    second := wallet.GenerateWallet()
+    third := wallet.GenerateWallet()
+
+    script, err := wallet.NewMultisigScript(2, [][]byte{first.GetPublicKey(), second.GetPublicKey(), third.GetPublicKey()})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tx, err := wallet.NewMultisigTransaction(script, second.GetWallet(), 10, 10, 1, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    firstTx, thirdTx := tx, tx
+    first.SignMultisig(&firstTx)
+    third.SignMultisig(&thirdTx)
+
+    if valid, _ := blockchain.VerifyTransactionSignature(firstTx); valid {
+        t.Error("One signature is enough for a 2 of 3 address")
+    }
+
+    combined, err := wallet.CombineSignatures([]wallet.Transaction{firstTx, thirdTx})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if valid, err := blockchain.VerifyTransactionSignature(combined); !valid {
+        t.Error("Combined signatures are invalid", err)
+    }
+
+    combined.Amount = 20
+    if valid, _ := blockchain.VerifyTransactionSignature(combined); valid {
+        t.Error("Changed transaction is still valid")
+    }
+}
+
 func TestHotpatch(t *testing.T) {
     diff := protocol.FindDiff("../.testfiles/v1", "../.testfiles/v2")
     diff.Apply("../.testfiles/v1", "../.testfiles/v3")
@@ -0,0 +1,164 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/badlamb/dexm/params"
+	"github.com/minio/blake2b-simd"
+	"golang.org/x/crypto/ripemd160"
+)
+
+/*
+An address is the network prefix, the Base58 encoding of the ripemd160 of
+the blake2b hash of a public key or multisig script, and the CRC32 of that
+ripemd160 digest as 8 hex digits:
+
+	Dexm + Base58(ripemd160(blake2b(key))) + %08x CRC32
+
+The burn address is the only one that doesn't follow this format.
+*/
+
+// Length of the ripemd160 digest in an address
+const ADDRESS_DIGEST_SIZE = ripemd160.Size
+
+// Length of the hex encoded checksum at the end of an address
+const ADDRESS_CHECKSUM_SIZE = 8
+
+// Addresses with this body belong to the burn address
+const burnBody = "2Rb2gmuR7ZwwUn1xD9vBdPC44tuM"
+
+func BytesToAddress(data []byte) string {
+	hash := blake2b.Sum256(data)
+
+	h := ripemd160.New()
+	h.Write(hash[:])
+
+	return digestToAddress(h.Sum(nil))
+}
+
+func digestToAddress(digest []byte) string {
+	body := Base58Encoding(digest)
+	if body == burnBody {
+		return BurnAddress()
+	}
+
+	return fmt.Sprintf("%s%s%08x", params.Active.AddressPrefix, body, crc32.ChecksumIEEE(digest))
+}
+
+// Returns the proof of burn address of the active network
+func BurnAddress() string {
+	return params.Active.AddressPrefix + "ProofOfBurn"
+}
+
+// Checks that an address belongs to the active network and that its
+// checksum matches, this way typos are caught before funds are lost.
+func ValidateAddress(address string) error {
+	if address == BurnAddress() {
+		return nil
+	}
+
+	if !strings.HasPrefix(address, params.Active.AddressPrefix) {
+		return errors.New("Address is not for the " + params.Active.Name + " network")
+	}
+
+	rest := address[len(params.Active.AddressPrefix):]
+	if len(rest) <= ADDRESS_CHECKSUM_SIZE {
+		return errors.New("Address is too short")
+	}
+
+	body := rest[:len(rest)-ADDRESS_CHECKSUM_SIZE]
+	digest, err := Base58Decoding(body)
+	if err != nil {
+		return err
+	}
+
+	// Encoding again rejects extra leading zeros
+	if len(digest) != ADDRESS_DIGEST_SIZE || Base58Encoding(digest) != body || body == burnBody {
+		return errors.New("Invalid address")
+	}
+
+	if digestToAddress(digest) != address {
+		return errors.New("Invalid address checksum")
+	}
+
+	return nil
+}
+
+// Taken from https://github.com/mr-tron/go-base58
+const b58digits_ordered string = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func Base58Encoding(bin []byte) string {
+	binsz := len(bin)
+	var i, j, high, zcount, carry int
+
+	for zcount < binsz && bin[zcount] == 0 {
+		zcount++
+	}
+
+	size := (binsz-zcount)*138/100 + 1
+	var buf = make([]byte, size)
+
+	high = size - 1
+	for i = zcount; i < binsz; i += 1 {
+		j = size - 1
+		for carry = int(bin[i]); j > high || carry != 0; j -= 1 {
+			carry = carry + 256*int(buf[j])
+			buf[j] = byte(carry % 58)
+			carry /= 58
+		}
+		high = j
+	}
+
+	for j = 0; j < size && buf[j] == 0; j += 1 {
+	}
+
+	var b58 = make([]byte, size-j+zcount)
+
+	if zcount != 0 {
+		for i = 0; i < zcount; i++ {
+			b58[i] = '1'
+		}
+	}
+
+	for i = zcount; j < size; i += 1 {
+		b58[i] = b58digits_ordered[buf[j]]
+		j += 1
+	}
+
+	return string(b58)
+}
+
+// Decodes a Base58 string, leading 1s become zero bytes
+func Base58Decoding(str string) ([]byte, error) {
+	var zcount int
+	for zcount < len(str) && str[zcount] == '1' {
+		zcount++
+	}
+
+	// Every digit holds log(58)/log(256) bytes
+	size := (len(str)-zcount)*733/1000 + 1
+	var buf = make([]byte, size)
+
+	for i := zcount; i < len(str); i++ {
+		carry := strings.IndexByte(b58digits_ordered, str[i])
+		if carry < 0 {
+			return nil, errors.New("Invalid Base58 character " + string(str[i]))
+		}
+
+		for j := size - 1; j >= 0; j-- {
+			carry += 58 * int(buf[j])
+			buf[j] = byte(carry % 256)
+			carry /= 256
+		}
+	}
+
+	var j int
+	for j < size && buf[j] == 0 {
+		j++
+	}
+
+	return append(make([]byte, zcount), buf[j:]...), nil
+}
@@ -0,0 +1,206 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"sort"
+
+	"github.com/badlamb/dexm/coin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Most keys a multisig address can have
+const MAX_MULTISIG_KEYS = 15
+
+// Sender of multisig transactions starts with this. Public keys are DER
+// encoded and always start with 0x30, so the two can't be confused.
+var multisigPrefix = []byte("multisig")
+
+// An m-of-n multisig address, Threshold signatures out of the keys are
+// needed to spend from it. Keys are x509 encoded public keys.
+type MultisigScript struct {
+	Threshold  int      `bson:"m" json:"threshold"`
+	PublicKeys [][]byte `bson:"k" json:"publicKeys"`
+}
+
+// Signature of the key at index Key of the multisig script
+type MultiSignature struct {
+	Key int       `bson:"k" json:"key"`
+	Sig [2][]byte `bson:"s" json:"sig"`
+}
+
+// Creates an m-of-n script. Keys are sorted, this way the address doesn't
+// depend on the order they are given in.
+func NewMultisigScript(threshold int, keys [][]byte) (*MultisigScript, error) {
+	sorted := [][]byte{}
+	for _, v := range keys {
+		sorted = append(sorted, append([]byte{}, v...))
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	script := &MultisigScript{
+		Threshold:  threshold,
+		PublicKeys: sorted,
+	}
+
+	return script, script.Validate()
+}
+
+// Checks that the threshold and keys of a script are usable
+func (m *MultisigScript) Validate() error {
+	if len(m.PublicKeys) == 0 || len(m.PublicKeys) > MAX_MULTISIG_KEYS {
+		return errors.New("Invalid number of keys")
+	}
+
+	if m.Threshold < 1 || m.Threshold > len(m.PublicKeys) {
+		return errors.New("Invalid threshold")
+	}
+
+	for k, v := range m.PublicKeys {
+		if k > 0 && bytes.Compare(m.PublicKeys[k-1], v) >= 0 {
+			return errors.New("Keys are not sorted or have duplicates")
+		}
+
+		_, err := ParsePublicKey(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the script as used in the Sender field of a transaction
+func (m *MultisigScript) Encode() []byte {
+	encoded, _ := bson.Marshal(m)
+	return append(append([]byte{}, multisigPrefix...), encoded...)
+}
+
+// Returns the address funds for the script are sent to
+func (m *MultisigScript) GetAddress() string {
+	return BytesToAddress(m.Encode())
+}
+
+// Checks if a transaction sender is a multisig script
+func IsMultisigSender(sender []byte) bool {
+	return bytes.HasPrefix(sender, multisigPrefix)
+}
+
+// Decodes and validates the script in the Sender field of a transaction
+func DecodeMultisigScript(sender []byte) (*MultisigScript, error) {
+	if !IsMultisigSender(sender) {
+		return nil, errors.New("Sender is not a multisig script")
+	}
+
+	var script MultisigScript
+	err := bson.Unmarshal(sender[len(multisigPrefix):], &script)
+	if err != nil {
+		return nil, err
+	}
+
+	return &script, script.Validate()
+}
+
+// Parses an x509 encoded ECDSA public key
+func ParsePublicKey(key []byte) (*ecdsa.PublicKey, error) {
+	generic, err := x509.ParsePKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := generic.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Key is not an ECDSA key")
+	}
+
+	return pub, nil
+}
+
+// Makes an unsigned transaction spending from a multisig address. It has to
+// be signed by enough keys with SignMultisig before it's valid.
+func NewMultisigTransaction(script *MultisigScript, recipient string, amount, gas coin.Amount, nonce int, timestamp int64) (Transaction, error) {
+	err := ValidateAddress(recipient)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return Transaction{
+		Sender:      script.Encode(),
+		Recipient:   recipient,
+		Amount:      amount,
+		Gas:         gas,
+		SenderNonce: nonce,
+		Timestamp:   timestamp,
+	}, nil
+}
+
+// Adds the signature of this wallet to a multisig transaction
+func (w *Wallet) SignMultisig(t *Transaction) error {
+	script, err := DecodeMultisigScript(t.Sender)
+	if err != nil {
+		return err
+	}
+
+	key := w.GetPublicKey()
+	for k, v := range script.PublicKeys {
+		if !bytes.Equal(v, key) {
+			continue
+		}
+
+		r, s := w.Sign(t.SigningHash())
+		signature := MultiSignature{Key: k, Sig: [2][]byte{r.Bytes(), s.Bytes()}}
+
+		return t.addSignature(signature)
+	}
+
+	return errors.New("Wallet is not part of the multisig address")
+}
+
+// Adds a signature keeping them sorted by key, a key can only sign once
+func (t *Transaction) addSignature(signature MultiSignature) error {
+	for k, v := range t.Signatures {
+		if v.Key == signature.Key {
+			t.Signatures[k] = signature
+			return nil
+		}
+	}
+
+	t.Signatures = append(t.Signatures, signature)
+	sort.Slice(t.Signatures, func(i, j int) bool {
+		return t.Signatures[i].Key < t.Signatures[j].Key
+	})
+
+	return nil
+}
+
+// Merges the signatures of copies of the same multisig transaction signed
+// by different keys
+func CombineSignatures(transactions []Transaction) (Transaction, error) {
+	if len(transactions) == 0 {
+		return Transaction{}, errors.New("No transactions to combine")
+	}
+
+	result := transactions[0]
+	result.Signatures = nil
+
+	hash := result.SigningHash()
+	for _, t := range transactions {
+		if !bytes.Equal(t.SigningHash(), hash) {
+			return Transaction{}, errors.New("Transactions are different")
+		}
+
+		for _, v := range t.Signatures {
+			err := result.addSignature(v)
+			if err != nil {
+				return Transaction{}, err
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -8,23 +8,20 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
-	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"math/big"
 	"time"
 
+	"github.com/badlamb/dexm/coin"
 	"github.com/minio/blake2b-simd"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ripemd160"
 	"gopkg.in/mgo.v2/bson"
-	"strings"
 )
 
 type Wallet struct {
 	PrivKey *ecdsa.PrivateKey
 	Nonce   int
-	Balance int
+	Balance coin.Amount
 }
 
 type WalletFile struct {
@@ -32,7 +29,7 @@ type WalletFile struct {
 	PrivKeyString string
 	Address string
 	Nonce         int
-	Balance       int
+	Balance       coin.Amount
 }
 
 func GenerateWallet() *Wallet {
@@ -94,29 +91,17 @@ func (w *Wallet) ExportWallet(filePath string) {
 }
 
 func (w *Wallet) GetWallet() string {
+	return BytesToAddress(w.GetPublicKey())
+}
+
+// Returns the x509 encoded public key of the wallet
+func (w *Wallet) GetPublicKey() []byte {
 	x509Encoded, err := x509.MarshalPKIXPublicKey(&w.PrivKey.PublicKey)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return BytesToAddress(x509Encoded)
-}
-
-func BytesToAddress(data []byte) string {
-	hash := blake2b.Sum256(data)
-
-	h := ripemd160.New()
-	h.Write(hash[:])
-
-	sum := crc32.ChecksumIEEE(hash[:])
-
-	wal := fmt.Sprintf("Dexm%s%x", Base58Encoding(h.Sum(nil)), sum)
-
-	if wal == "Dexm2Rb2gmuR7ZwwUn1xD9vBdPC44tuM1f45b145" {
-		return "DexmProofOfBurn"
-	}
-
-	return wal
+	return x509Encoded
 }
 
 func (w *Wallet) Sign(data []byte) (r, s *big.Int) {
@@ -128,91 +113,110 @@ func (w *Wallet) Sign(data []byte) (r, s *big.Int) {
 	return r, s
 }
 
-// Taken from https://github.com/mr-tron/go-base58
-const b58digits_ordered string = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+type Transaction struct {
+	Sender    []byte `bson:"s"`
+	Recipient string `bson:"r"`
 
-func Base58Encoding(bin []byte) string {
-	binsz := len(bin)
-	var i, j, high, zcount, carry int
+	Amount      coin.Amount `bson:"a"`
+	Gas         coin.Amount `bson:"g"`
+	SenderNonce int         `bson:"n"`
+	Timestamp   int64       `bson:"t"`
+	SenderSig   [2][]byte   `bson:"rs"`
 
-	for zcount < binsz && bin[zcount] == 0 {
-		zcount++
-	}
+	// Code attached to the transaction, it pays more gas per byte
+	Contract []byte `bson:"c,omitempty"`
 
-	size := (binsz-zcount)*138/100 + 1
-	var buf = make([]byte, size)
+	// Used instead of SenderSig when Sender is a multisig script
+	Signatures []MultiSignature `bson:"ms,omitempty"`
 
-	high = size - 1
-	for i = zcount; i < binsz; i += 1 {
-		j = size - 1
-		for carry = int(bin[i]); j > high || carry != 0; j -= 1 {
-			carry = carry + 256*int(buf[j])
-			buf[j] = byte(carry % 58)
-			carry /= 58
-		}
-		high = j
-	}
+	// First block height, or Unix time if it's at least LOCK_TIME_THRESHOLD,
+	// at which the transaction can be included. Zero means no lock.
+	Lock int64 `bson:"l,omitempty"`
+}
 
-	for j = 0; j < size && buf[j] == 0; j += 1 {
-	}
+// Locks below this are block heights, the others are Unix times
+const LOCK_TIME_THRESHOLD = 500000000
 
-	var b58 = make([]byte, size-j+zcount)
+// Returns the hash signed by the sender, signatures aren't part of it
+func (t Transaction) SigningHash() []byte {
+	t.SenderSig = [2][]byte{}
+	t.Signatures = nil
 
-	if zcount != 0 {
-		for i = 0; i < zcount; i++ {
-			b58[i] = '1'
-		}
+	encoded, err := bson.Marshal(t)
+	if err != nil {
+		log.Error(err)
+		return nil
 	}
 
-	for i = zcount; j < size; i += 1 {
-		b58[i] = b58digits_ordered[buf[j]]
-		j += 1
+	hash := blake2b.Sum256(encoded)
+	return hash[:]
+}
+
+// Returns the id of a transaction, the hash of the signed transaction
+func (t Transaction) GetHash() []byte {
+	encoded, err := bson.Marshal(t)
+	if err != nil {
+		log.Error(err)
+		return nil
 	}
 
-	return string(b58)
+	hash := blake2b.Sum256(encoded)
+	return hash[:]
 }
 
-type Transaction struct {
-	Sender    []byte `bson:"s"`
-	Recipient string `bson:"r"`
+func (w *Wallet) NewTransaction(recipient string, amount, gas coin.Amount) (Transaction, error) {
+	return w.makeTransaction(recipient, amount, gas, 0, nil)
+}
 
-	Amount      int       `bson:"a"`
-	Gas         int       `bson:"g"`
-	SenderNonce int       `bson:"n"`
-	Timestamp   int64     `bson:"t"`
-	SenderSig   [2][]byte `bson:"rs"`
+// Makes a transaction that can't be included before lock, see Transaction.Lock
+func (w *Wallet) NewLockedTransaction(recipient string, amount, gas coin.Amount, lock int64) (Transaction, error) {
+	return w.makeTransaction(recipient, amount, gas, lock, nil)
 }
 
-func (w *Wallet) NewTransaction(recipient string, amount, gas int) (Transaction, error) {
-	if amount+gas > w.Balance {
+// Makes a transaction with a contract attached
+func (w *Wallet) NewContractTransaction(recipient string, amount, gas coin.Amount, contract []byte) (Transaction, error) {
+	return w.makeTransaction(recipient, amount, gas, 0, contract)
+}
+
+func (w *Wallet) makeTransaction(recipient string, amount, gas coin.Amount, lock int64, contract []byte) (Transaction, error) {
+	if lock < 0 {
+		return Transaction{}, errors.New("Lock can't be negative")
+	}
+
+	spent, err := amount.Add(gas)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	if spent > w.Balance {
 		return Transaction{}, errors.New("Only cobwebs here!")
 	}
 
-	if !strings.HasPrefix(recipient, "Dexm") && len(recipient) > 30 {
-		log.Error("Invalid recipient")
+	err = ValidateAddress(recipient)
+	if err != nil {
+		return Transaction{}, err
 	}
 
 	w.Nonce++
-	w.Balance -= amount + gas
-
-	x509Encoded, err := x509.MarshalPKIXPublicKey(&w.PrivKey.PublicKey)
+	w.Balance, err = w.Balance.Sub(spent)
 	if err != nil {
-		log.Fatal(err)
+		return Transaction{}, err
 	}
 
 	newT := Transaction{
-		Sender:      x509Encoded,
+		Sender:      w.GetPublicKey(),
 		Recipient:   recipient,
 		Amount:      amount,
 		Gas:         gas,
 		SenderNonce: w.Nonce,
 		Timestamp:   time.Now().Unix(),
+		Contract:    contract,
+		Lock:        lock,
 	}
 
-	result, _ := bson.Marshal(newT)
-	log.Info(string(result))
-
-	r, s := w.Sign(result)
+	// ECDSA only uses as many bytes as the curve has, so the whole
+	// transaction has to be hashed first
+	r, s := w.Sign(newT.SigningHash())
 
 	sig := [2][]byte{}
 	sig[0] = r.Bytes()